@@ -0,0 +1,229 @@
+package rig
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrListUnsupported is returned when an operation needs to list
+// objects but the object store does not implement Lister.
+var ErrListUnsupported = errors.New("rig: object store does not support listing")
+
+// Archive provides read-only access to the snapshots and log
+// records stored under a prefix.
+type Archive struct {
+	objectStore ObjectStore
+	prefix      string
+}
+
+// LogRecord describes a log record object.
+type LogRecord struct {
+	Name string
+	// Version is the version of the first operation in the batch.
+	Version uint64
+	// Timestamp is set for the timestamped copies of a log record
+	// written by the first flush of a process.
+	Timestamp int64
+}
+
+func NewArchive(objectStore ObjectStore, prefix string) *Archive {
+	return &Archive{
+		objectStore: objectStore,
+		prefix:      prefix,
+	}
+}
+
+// LatestSnapshotVersion returns the version of the snapshot that
+// LATEST points to.
+func (a *Archive) LatestSnapshotVersion() (uint64, error) {
+	r, err := a.objectStore.GetObject(latestObjectName(a.prefix))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 16, 64)
+}
+
+// OpenSnapshot returns a reader for the snapshot at a version.
+func (a *Archive) OpenSnapshot(version uint64) (io.ReadCloser, error) {
+	return a.objectStore.GetObject(snapshotName(a.prefix, version))
+}
+
+// ReadLogBatch returns the operations in the log record starting at a version.
+func (a *Archive) ReadLogBatch(version uint64) ([]Operation, error) {
+	return a.ReadLogRecord(logRecordName(a.prefix, version))
+}
+
+// ReadLogRecord returns the operations in the named log record.
+func (a *Archive) ReadLogRecord(name string) ([]Operation, error) {
+	batch, err := a.readLogRecord(name)
+	return batch.Operations, err
+}
+
+func (a *Archive) readObject(name string) ([]byte, error) {
+	r, err := a.objectStore.GetObject(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (a *Archive) readLogRecord(name string) (logBatch, error) {
+	r, err := a.objectStore.GetObject(name)
+	if err != nil {
+		return logBatch{}, err
+	}
+	defer r.Close()
+	return decodeLogBatch(r)
+}
+
+// SnapshotVersions returns the versions of all stored snapshots
+// in increasing order.
+func (a *Archive) SnapshotVersions() ([]uint64, error) {
+	lister, ok := a.objectStore.(Lister)
+	if !ok {
+		return nil, ErrListUnsupported
+	}
+	names, err := lister.ListObjects(filepath.Join(a.prefix, "SNAPSHOT"))
+	if err != nil {
+		return nil, err
+	}
+	versions := []uint64{}
+	for _, name := range names {
+		version, err := strconv.ParseUint(filepath.Base(name), 16, 64)
+		if err != nil {
+			// Not a snapshot
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// LogRecords returns all stored log records ordered by version.
+// Timestamped copies are ordered after the record they duplicate.
+func (a *Archive) LogRecords() ([]LogRecord, error) {
+	lister, ok := a.objectStore.(Lister)
+	if !ok {
+		return nil, ErrListUnsupported
+	}
+	names, err := lister.ListObjects(filepath.Join(a.prefix, "LOG"))
+	if err != nil {
+		return nil, err
+	}
+	records := []LogRecord{}
+	for _, name := range names {
+		record, ok := parseLogRecordName(name)
+		if !ok {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Version != records[j].Version {
+			return records[i].Version < records[j].Version
+		}
+		return records[i].Timestamp < records[j].Timestamp
+	})
+	return records, nil
+}
+
+func parseLogRecordName(name string) (LogRecord, bool) {
+	base := filepath.Base(name)
+	record := LogRecord{Name: name}
+	if i := strings.IndexByte(base, '-'); i >= 0 {
+		timestamp, err := strconv.ParseInt(base[i+1:], 10, 64)
+		if err != nil {
+			return record, false
+		}
+		record.Timestamp = timestamp
+		base = base[:i]
+	}
+	version, err := strconv.ParseUint(base, 16, 64)
+	if err != nil {
+		return record, false
+	}
+	record.Version = version
+	return record, true
+}
+
+// logBatch is the contents of a log record. Records used to be
+// a JSON array of operations, which decodeLogBatch still reads.
+type logBatch struct {
+	// Version is the version of the first operation.
+	Version    uint64      `json:"version,omitempty"`
+	Operations []Operation `json:"operations"`
+	// Digest is the digest of the service's state
+	// after the last operation, if it has one.
+	Digest []byte `json:"digest,omitempty"`
+	// Previous is the hash of the previous log record.
+	Previous []byte `json:"previous,omitempty"`
+	// Signature is the signature of the rest of the batch,
+	// if the service has a signing key.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+func encodeLogBatch(batch logBatch) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	err := json.NewEncoder(w).Encode(batch)
+	if err != nil {
+		return nil, err
+	}
+	w.Flush()
+	w.Close()
+	return buf, nil
+}
+
+func decodeLogBatch(r io.Reader) (logBatch, error) {
+	batch := logBatch{}
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return batch, err
+	}
+	var raw json.RawMessage
+	err = json.NewDecoder(gzipReader).Decode(&raw)
+	if err != nil {
+		return batch, err
+	}
+	if len(raw) > 0 && raw[0] == '[' {
+		err = json.Unmarshal(raw, &batch.Operations)
+	} else {
+		err = json.Unmarshal(raw, &batch)
+	}
+	if err == nil && batch.Operations == nil {
+		batch.Operations = []Operation{}
+	}
+	return batch, err
+}
+
+func snapshotName(prefix string, snapshot uint64) string {
+	return filepath.Join(prefix, "SNAPSHOT", fmt.Sprintf("%016x", snapshot))
+}
+
+func snapshotManifestName(prefix string, snapshot uint64) string {
+	return snapshotName(prefix, snapshot) + ".manifest"
+}
+
+func logRecordName(prefix string, version uint64) string {
+	return filepath.Join(prefix, "LOG", fmt.Sprintf("%016x", version))
+}
+
+func latestObjectName(prefix string) string {
+	return filepath.Join(prefix, "LATEST")
+}
@@ -0,0 +1,95 @@
+package rig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func putLogBatch(t *testing.T, objectStore ObjectStore, name string, ops []Operation) {
+	buf, err := encodeLogBatch(logBatch{Operations: ops})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = objectStore.PutObject(name, bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectStore := NewFileObjectStore(dir)
+
+	rs, err := NewRiggedService(&testService{}, objectStore, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(Operation{}, false)
+	rs.Apply(Operation{}, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(Operation{}, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := rs.Archive()
+	records, err := archive.LogRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first flush also writes a timestamped copy.
+	if len(records) != 3 || records[0].Version != 1 || records[1].Timestamp == 0 || records[2].Version != 3 {
+		t.Fatalf("unexpected log records %+v", records)
+	}
+	report, err := archive.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.LastVersion != 3 || report.Batches != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	putLogBatch(t, objectStore, logRecordName("svc", 3), []Operation{{}, {}})
+	putLogBatch(t, objectStore, logRecordName("svc", 7), []Operation{{}})
+	err = objectStore.PutObject(logRecordName("svc", 8), bytes.NewReader([]byte("garbage")), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putLogBatch(t, objectStore, logRecordName("svc", 2), []Operation{{}})
+	report, err = archive.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Gaps) != 1 || report.Gaps[0] != (VersionRange{First: 5, Last: 6}) {
+		t.Fatalf("unexpected gaps %+v", report.Gaps)
+	}
+	if len(report.Duplicates) != 1 || report.Duplicates[0] != (VersionRange{First: 2, Last: 2}) {
+		t.Fatalf("unexpected duplicates %+v", report.Duplicates)
+	}
+	if len(report.Undecodable) != 1 || report.Undecodable[0] != logRecordName("svc", 8) {
+		t.Fatalf("unexpected undecodable records %+v", report.Undecodable)
+	}
+	if report.LastVersion != 7 {
+		t.Fatalf("expected last version 7, got %d", report.LastVersion)
+	}
+
+	// Versions covered by a snapshot are not checked.
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	report, err = archive.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SnapshotVersion != 3 || len(report.Duplicates) != 0 || len(report.Gaps) != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
@@ -0,0 +1,274 @@
+package rig
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrBackpressure is returned by ApplyBatch when there are
+	// too many pending operations and the policy is BackpressureReject.
+	ErrBackpressure = errors.New("rig: too many pending operations")
+	// ErrRateLimited is returned by ApplyBatch when a method is over
+	// its rate limit and the policy isn't BackpressureBlock. Operations
+	// that fail validation or aren't applied for another reason don't
+	// count against the limit.
+	ErrRateLimited = errors.New("rig: rate limited")
+)
+
+// BackpressurePolicy is what ApplyBatch does when operations
+// can't be applied yet.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock waits until the operations can be applied
+	// or the context is done.
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureReject returns ErrBackpressure or ErrRateLimited.
+	BackpressureReject
+	// BackpressureFlush flushes pending operations and returns
+	// ErrBackpressure if that doesn't make room. Rate limited
+	// operations are rejected.
+	BackpressureFlush
+)
+
+// Limits limits the operations that haven't been flushed yet.
+// Zero values have no limit.
+type Limits struct {
+	MaxPendingOperations int
+	MaxPendingBytes      int64
+	Policy               BackpressurePolicy
+}
+
+// SetLimits sets the limits on pending operations. A batch is
+// always accepted when nothing is pending, even if it's over the limits.
+func (rs *RiggedService) SetLimits(limits Limits) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.limits = limits
+	rs.signalDrained()
+}
+
+// SetRateLimit limits the rate of operations with a method to rate per
+// second, with bursts of up to burst operations. A zero rate removes
+// the limit.
+func (rs *RiggedService) SetRateLimit(method string, rate float64, burst int) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if rate <= 0 {
+		delete(rs.rateLimits, method)
+		return
+	}
+	if rs.rateLimits == nil {
+		rs.rateLimits = map[string]*tokenBucket{}
+	}
+	rs.rateLimits[method] = newTokenBucket(rate, burst, time.Now())
+}
+
+// admit waits until ops are within the rate limits and there
+// is room for them, depending on the policy. It returns with
+// rs.lock held if there is no error.
+func (rs *RiggedService) admit(ctx context.Context, ops []Operation) error {
+	flushed := false
+	for {
+		rs.lock.Lock()
+		if err := rs.writable(); err != nil {
+			rs.lock.Unlock()
+			return err
+		}
+		policy := rs.limits.Policy
+		wait, err := rs.tokenWait(ops)
+		if err != nil {
+			rs.lock.Unlock()
+			return err
+		}
+		if wait > 0 {
+			rs.lock.Unlock()
+			if policy != BackpressureBlock {
+				return ErrRateLimited
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			continue
+		}
+		if rs.hasRoom(ops) {
+			rs.takeTokens(ops)
+			return nil
+		}
+		switch policy {
+		case BackpressureReject:
+			rs.lock.Unlock()
+			return ErrBackpressure
+		case BackpressureFlush:
+			if !flushed {
+				flushed = true
+				_, err = rs.flush()
+				if err != nil {
+					rs.lastFlushErr = err
+					rs.lastFlushErrTime = time.Now()
+					rs.publishStatus()
+				}
+			}
+			if !rs.hasRoom(ops) {
+				rs.lock.Unlock()
+				return ErrBackpressure
+			}
+			rs.lock.Unlock()
+		default:
+			drained := rs.drainedChan()
+			rs.lock.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-drained:
+			}
+		}
+	}
+}
+
+// hasRoom returns true if ops can be added to the pending
+// operations. The caller must hold rs.lock.
+func (rs *RiggedService) hasRoom(ops []Operation) bool {
+	if len(rs.pending) == 0 {
+		return true
+	}
+	limits := rs.limits
+	if limits.MaxPendingOperations > 0 && len(rs.pending)+len(ops) > limits.MaxPendingOperations {
+		return false
+	}
+	if limits.MaxPendingBytes > 0 {
+		size := rs.pendingBytes
+		for _, op := range ops {
+			size += operationSize(op)
+		}
+		if size > limits.MaxPendingBytes {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenWait returns how long to wait until the rate limits of the
+// methods of ops have a token for each of them. The caller must hold
+// rs.lock.
+func (rs *RiggedService) tokenWait(ops []Operation) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for method, count := range rs.rateLimitedMethods(ops) {
+		bucket := rs.rateLimits[method]
+		if count > bucket.burst {
+			// It would never have enough tokens.
+			return 0, ErrRateLimited
+		}
+		if w := bucket.wait(count, now); w > wait {
+			wait = w
+		}
+	}
+	return wait, nil
+}
+
+// takeTokens takes a token for each operation from the rate
+// limits of their methods. The caller must hold rs.lock.
+func (rs *RiggedService) takeTokens(ops []Operation) {
+	for method, count := range rs.rateLimitedMethods(ops) {
+		rs.rateLimits[method].take(count)
+	}
+}
+
+// refundTokens returns the tokens taken for operations that weren't
+// applied. The caller must hold rs.lock.
+func (rs *RiggedService) refundTokens(ops []Operation) {
+	for method, count := range rs.rateLimitedMethods(ops) {
+		rs.rateLimits[method].refund(count)
+	}
+}
+
+// rateLimitedMethods counts the operations by method
+// for methods that have rate limits.
+func (rs *RiggedService) rateLimitedMethods(ops []Operation) map[string]int {
+	counts := map[string]int{}
+	if len(rs.rateLimits) == 0 {
+		return counts
+	}
+	for _, op := range ops {
+		if _, ok := rs.rateLimits[op.Method]; ok {
+			counts[op.Method]++
+		}
+	}
+	return counts
+}
+
+// drainedChan returns a channel that is closed when pending operations
+// are flushed or the limits change. The caller must hold rs.lock.
+func (rs *RiggedService) drainedChan() chan struct{} {
+	if rs.drained == nil {
+		rs.drained = make(chan struct{})
+	}
+	return rs.drained
+}
+
+// signalDrained wakes up ApplyBatch calls waiting for room.
+// The caller must hold rs.lock.
+func (rs *RiggedService) signalDrained() {
+	if rs.drained != nil {
+		close(rs.drained)
+		rs.drained = nil
+	}
+}
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+		b.last = now
+	}
+}
+
+// wait returns how long to wait until n tokens are available.
+func (b *tokenBucket) wait(n int, now time.Time) time.Duration {
+	b.refill(now)
+	missing := float64(n) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n int) {
+	b.tokens -= float64(n)
+}
+
+func (b *tokenBucket) refund(n int) {
+	b.tokens += float64(n)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+}
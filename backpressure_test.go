@@ -0,0 +1,124 @@
+package rig
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestRiggedService(t *testing.T) (*RiggedService, func()) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := NewRiggedService(&testService{}, NewFileObjectStore(dir), "svc")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return rs, func() { os.RemoveAll(dir) }
+}
+
+func TestBackpressure(t *testing.T) {
+	rs, cleanup := newTestRiggedService(t)
+	defer cleanup()
+	op := Operation{Method: "set", Data: []byte("abc")}
+
+	rs.SetLimits(Limits{MaxPendingOperations: 2, Policy: BackpressureReject})
+	for i := 0; i < 2; i++ {
+		if err := rs.Apply(op, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rs.Apply(op, false); err != ErrBackpressure {
+		t.Fatalf("expected ErrBackpressure, got %v", err)
+	}
+
+	rs.SetLimits(Limits{MaxPendingBytes: 12, Policy: BackpressureFlush})
+	if err := rs.Apply(op, false); err != nil {
+		t.Fatal(err)
+	}
+	if status := rs.Status(); status.LastFlush != 2 || status.Pending != 1 {
+		t.Fatalf("expected a flush before applying, got %+v", status)
+	}
+
+	rs.SetLimits(Limits{MaxPendingOperations: 1, Policy: BackpressureBlock})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := rs.ApplyBatch(ctx, []Operation{op}, false); err != context.DeadlineExceeded {
+		t.Fatalf("expected the context to time out, got %v", err)
+	}
+	applied := make(chan error)
+	go func() {
+		_, err := rs.ApplyBatch(context.Background(), []Operation{op}, false)
+		applied <- err
+	}()
+	select {
+	case err := <-applied:
+		t.Fatalf("expected ApplyBatch to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-applied; err != nil {
+		t.Fatal(err)
+	}
+	if status := rs.Status(); status.CurrentVersion != 4 {
+		t.Fatalf("expected version 4, got %d", status.CurrentVersion)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rs, cleanup := newTestRiggedService(t)
+	defer cleanup()
+
+	rs.SetLimits(Limits{Policy: BackpressureReject})
+	rs.SetRateLimit("noisy", 5, 2)
+	noisy := Operation{Method: "noisy"}
+	// Operations that aren't applied don't take tokens.
+	for i := 0; i < 3; i++ {
+		if _, err := rs.ApplyIf(context.Background(), 100, noisy, false); err != ErrVersionMismatch {
+			t.Fatalf("expected ErrVersionMismatch, got %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := rs.Apply(noisy, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rs.Apply(noisy, false); err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	// Other methods aren't limited.
+	if err := rs.Apply(Operation{Method: "quiet"}, false); err != nil {
+		t.Fatal(err)
+	}
+	// A batch larger than the burst can never be applied.
+	rs.SetLimits(Limits{Policy: BackpressureBlock})
+	if _, err := rs.ApplyBatch(context.Background(), []Operation{noisy, noisy, noisy}, false); err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+
+	start := time.Now()
+	if err := rs.Apply(noisy, false); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("expected to wait for a token, waited %v", waited)
+	}
+	// Waiting for a token stops when the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	version := rs.Status().CurrentVersion
+	if _, err := rs.ApplyIf(ctx, version, noisy, false); err != context.DeadlineExceeded {
+		t.Fatalf("expected the context to time out, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package rig
+
+import (
+	"encoding/json"
+)
+
+// BatchLimits limits the size of each log record written by Flush.
+// Pending operations that don't fit in one record are written to
+// several consecutive records. A record always has at least one
+// operation. Zero values have no limit.
+type BatchLimits struct {
+	MaxOperations int
+	// MaxBytes limits the size of the operations
+	// encoded as JSON, before compression.
+	MaxBytes int64
+}
+
+// DefaultBatchLimits are the batch limits of a new RiggedService.
+var DefaultBatchLimits = BatchLimits{
+	MaxOperations: 10000,
+	MaxBytes:      16 << 20,
+}
+
+// SetBatchLimits sets the limits on log records written by Flush.
+func (rs *RiggedService) SetBatchLimits(limits BatchLimits) {
+	rs.lock.Lock()
+	rs.batchLimits = limits
+	rs.lock.Unlock()
+}
+
+// nextBatch returns the number of pending operations
+// to write in the next log record.
+func (rs *RiggedService) nextBatch() int {
+	limits := rs.batchLimits
+	n := len(rs.pending)
+	if limits.MaxOperations > 0 && n > limits.MaxOperations {
+		n = limits.MaxOperations
+	}
+	if limits.MaxBytes <= 0 {
+		return n
+	}
+	// The brackets of the JSON array.
+	size := int64(2)
+	for i, op := range rs.pending[:n] {
+		size += encodedOperationSize(op)
+		if i > 0 {
+			// The comma before the operation.
+			size++
+		}
+		if size > limits.MaxBytes && i > 0 {
+			return i
+		}
+	}
+	return n
+}
+
+func encodedOperationSize(op Operation) int64 {
+	b, err := json.Marshal(op)
+	if err != nil {
+		// Encoding the batch will fail too.
+		return 0
+	}
+	return int64(len(b))
+}
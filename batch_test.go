@@ -0,0 +1,126 @@
+package rig
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// faultyObjectStore fails writes that fail returns an error for,
+// and counts the writes that reach the backing store.
+type faultyObjectStore struct {
+	ObjectStore
+
+	lock sync.Mutex
+	fail func(name string) error
+	puts map[string]int
+}
+
+func (o *faultyObjectStore) PutObject(name string, data io.ReadSeeker, size int64) error {
+	o.lock.Lock()
+	fail := o.fail
+	o.lock.Unlock()
+	if fail != nil {
+		if err := fail(name); err != nil {
+			return err
+		}
+	}
+	o.lock.Lock()
+	o.puts[name]++
+	o.lock.Unlock()
+	return o.ObjectStore.PutObject(name, data, size)
+}
+
+func (o *faultyObjectStore) setFail(fail func(name string) error) {
+	o.lock.Lock()
+	o.fail = fail
+	o.lock.Unlock()
+}
+
+func newFaultyRiggedService(t *testing.T, dir string) (*RiggedService, *faultyObjectStore) {
+	store := NewFileObjectStore(dir)
+	if err := createDirectories(store, "svc"); err != nil {
+		t.Fatal(err)
+	}
+	faulty := &faultyObjectStore{ObjectStore: store, puts: map[string]int{}}
+	rs, err := NewRiggedService(&testService{}, faulty, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	return rs, faulty
+}
+
+func logRecordVersions(t *testing.T, dir string) []uint64 {
+	records, err := NewArchive(NewFileObjectStore(dir), "svc").LogRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := []uint64{}
+	for _, record := range records {
+		if record.Timestamp == 0 {
+			versions = append(versions, record.Version)
+		}
+	}
+	return versions
+}
+
+func TestFlushBatchLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rs, store := newFaultyRiggedService(t, dir)
+	rs.SetBatchLimits(BatchLimits{MaxOperations: 3})
+	for i := 0; i < 8; i++ {
+		if err = rs.Apply(Operation{Method: "set"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errFailed := errors.New("failed")
+	store.setFail(func(name string) error {
+		if strings.HasSuffix(name, "LOG/0000000000000007") {
+			return errFailed
+		}
+		return nil
+	})
+	if n, err := rs.Flush(); n != 6 || err != errFailed {
+		t.Fatalf("expected 6 flushed operations and an error, got %d, %v", n, err)
+	}
+	if status := rs.Status(); status.LastFlush != 6 || status.Pending != 2 {
+		t.Fatalf("expected the uploaded batches to be dropped from pending, got %+v", status)
+	}
+	store.setFail(nil)
+	if n, err := rs.Flush(); n != 2 || err != nil {
+		t.Fatalf("expected 2 flushed operations, got %d, %v", n, err)
+	}
+
+	rs.SetBatchLimits(BatchLimits{MaxBytes: 100})
+	for i := 0; i < 3; i++ {
+		if err = rs.Apply(Operation{Method: "set", Data: []byte(strings.Repeat("x", 30))}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Each operation is too large to share a log record.
+	if got := fmt.Sprint(logRecordVersions(t, dir)); got != "[1 4 7 9 10 11]" {
+		t.Fatalf("unexpected log records %v", got)
+	}
+
+	recovered, _ := newFaultyRiggedService(t, dir)
+	if status := recovered.Status(); status.CurrentVersion != 11 {
+		t.Fatalf("expected to recover version 11, got %d", status.CurrentVersion)
+	}
+}
@@ -0,0 +1,691 @@
+// Package bptree implements an embedded key/value database stored in a
+// single file as a copy-on-write B+tree.
+//
+// Transactions are serializable: there is at most one read-write
+// transaction at a time, and read-only transactions see the state as of
+// the last commit when they started, without blocking writers. Each
+// commit also records an application-defined version, which is updated
+// atomically with the data.
+//
+// Commits only append to the file, so old versions of the tree use space
+// until the file is compacted with Compact. Usage reports how much of the
+// file is garbage. Snapshots only contain the current version of the tree.
+package bptree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// ErrReadOnly is returned when modifying a read-only transaction.
+	ErrReadOnly = errors.New("bptree: read-only transaction")
+	// ErrClosed is returned when using a closed database.
+	ErrClosed = errors.New("bptree: database closed")
+)
+
+// DB is a database file.
+type DB struct {
+	path string
+
+	// writeLock is held by read-write transactions
+	// and while replacing the file.
+	writeLock sync.Mutex
+
+	lock   sync.Mutex
+	file   *dbFile
+	header header
+}
+
+// Open opens the database file at path, creating it if it doesn't exist.
+func Open(path string) (*DB, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		f, err = createFile(path, func(f *os.File) (header, error) {
+			return header{end: dataOffset}, nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Discard anything left over from a commit that didn't finish.
+	err = f.Truncate(h.end)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Remove snapshots that weren't closed before the process exited.
+	leftover, _ := filepath.Glob(snapshotPattern(path) + "*")
+	for _, name := range leftover {
+		os.Remove(name)
+	}
+	return &DB{
+		path:   path,
+		file:   newDBFile(f),
+		header: h,
+	}, nil
+}
+
+// Close closes the database. Transactions and snapshots
+// that are still open can finish.
+func (db *DB) Close() error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.file == nil {
+		return ErrClosed
+	}
+	db.file.release()
+	db.file = nil
+	return nil
+}
+
+// current returns the file and header of the last commit.
+// The caller must release the file.
+func (db *DB) current() (*dbFile, header, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.file == nil {
+		return nil, header{}, ErrClosed
+	}
+	db.file.acquire()
+	return db.file, db.header, nil
+}
+
+// View runs fn in a read-only transaction.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	file, h, err := db.current()
+	if err != nil {
+		return err
+	}
+	defer file.release()
+	return fn(&Tx{
+		file:    file,
+		root:    childRef{offset: h.root},
+		version: h.version,
+	})
+}
+
+// Update runs fn in a read-write transaction, which is
+// committed if fn returns nil and discarded otherwise.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	file, h, err := db.current()
+	if err != nil {
+		return err
+	}
+	defer file.release()
+	tx := &Tx{
+		file:     file,
+		root:     childRef{offset: h.root},
+		version:  h.version,
+		writable: true,
+	}
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return db.commit(tx, h)
+}
+
+// commit appends the nodes modified by a transaction and then
+// writes the header. The caller must hold writeLock.
+func (db *DB) commit(tx *Tx, h header) error {
+	buf := []byte{}
+	var written []*node
+	root := tx.root.offset
+	if tx.root.node != nil {
+		root = writeNodes(tx.root.node, h.end, &buf, &written)
+	}
+	if len(buf) > 0 {
+		_, err := tx.file.f.WriteAt(buf, h.end)
+		if err != nil {
+			return err
+		}
+		err = tx.file.f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	next := header{
+		txid:    h.txid + 1,
+		root:    root,
+		end:     h.end + int64(len(buf)),
+		version: tx.version,
+		live:    h.live + int64(len(buf)) - tx.freed,
+	}
+	_, err := tx.file.f.WriteAt(next.encode(), int64(next.txid%2)*headerSlotSize)
+	if err != nil {
+		return err
+	}
+	err = tx.file.f.Sync()
+	if err != nil {
+		return err
+	}
+	for _, n := range written {
+		tx.file.cacheNode(n)
+	}
+	db.lock.Lock()
+	db.header = next
+	db.lock.Unlock()
+	return nil
+}
+
+// writeNodes encodes a modified node and its modified descendants,
+// children first, as if buf starts at offset base. It returns the
+// offset of n.
+func writeNodes(n *node, base int64, buf *[]byte, written *[]*node) int64 {
+	for i, child := range n.children {
+		if child.node != nil {
+			n.children[i] = childRef{offset: writeNodes(child.node, base, buf, written)}
+		}
+	}
+	n.offset = base + int64(len(*buf))
+	start := len(*buf)
+	*buf = n.encode(*buf)
+	n.recordSize = len(*buf) - start
+	*written = append(*written, n)
+	return n.offset
+}
+
+// Version returns the version of the last commit.
+func (db *DB) Version() (uint64, error) {
+	var version uint64
+	err := db.View(func(tx *Tx) error {
+		version = tx.Version()
+		return nil
+	})
+	return version, err
+}
+
+// Usage returns the size of the records reachable from the current
+// tree and the size of the records left over from older versions,
+// which are removed by Compact.
+func (db *DB) Usage() (live, garbage int64, err error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.file == nil {
+		return 0, 0, ErrClosed
+	}
+	return db.header.live, db.header.end - dataOffset - db.header.live, nil
+}
+
+// Snapshot is a compacted copy of the database file.
+// It must be closed after it is read.
+type Snapshot struct {
+	*io.SectionReader
+	f         *os.File
+	closeOnce sync.Once
+}
+
+// Close removes the snapshot's file.
+func (s *Snapshot) Close() error {
+	s.closeOnce.Do(func() {
+		s.f.Close()
+		os.Remove(s.f.Name())
+	})
+	return nil
+}
+
+// snapshotPattern returns the prefix of the
+// names of snapshot files for a database file.
+func snapshotPattern(path string) string {
+	return filepath.Base(path) + ".snapshot-"
+}
+
+// Snapshot returns a copy of the database file with only the tree as of
+// the last commit, which can be restored with Restore. It is written to a
+// temporary file next to the database, and commits can continue while it
+// is being written and read.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	file, h, err := db.current()
+	if err != nil {
+		return nil, err
+	}
+	defer file.release()
+	f, err := ioutil.TempFile(filepath.Dir(db.path), snapshotPattern(db.path))
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{f: f}
+	if _, err = f.Seek(dataOffset, 0); err == nil {
+		h, err = compactTree(file, h, f)
+	}
+	if err == nil {
+		_, err = f.WriteAt(headerBytes(h), 0)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.SectionReader = io.NewSectionReader(f, 0, h.end)
+	return s, nil
+}
+
+// Restore replaces the database with a file read from r,
+// like one written from a Snapshot.
+func (db *DB) Restore(r io.Reader) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	file, _, err := db.current()
+	if err != nil {
+		return err
+	}
+	file.release()
+	f, err := createFile(db.path, func(f *os.File) (header, error) {
+		_, err := f.Seek(0, 0)
+		if err != nil {
+			return header{}, err
+		}
+		size, err := io.Copy(f, r)
+		if err != nil {
+			return header{}, err
+		}
+		h, err := readHeader(f)
+		if err != nil {
+			return header{}, err
+		}
+		if h.end > size {
+			return header{}, ErrCorrupt
+		}
+		return h, nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.reopen(f)
+}
+
+// reopen replaces the file with one written by createFile.
+// The caller must hold writeLock.
+func (db *DB) reopen(f *os.File) error {
+	h, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	db.lock.Lock()
+	old := db.file
+	db.file = newDBFile(f)
+	db.header = h
+	db.lock.Unlock()
+	old.release()
+	return nil
+}
+
+// Compact rewrites the database file with only the current
+// version of the tree.
+func (db *DB) Compact() error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	file, h, err := db.current()
+	if err != nil {
+		return err
+	}
+	defer file.release()
+	f, err := createFile(db.path, func(f *os.File) (header, error) {
+		return compactTree(file, h, f)
+	})
+	if err != nil {
+		return err
+	}
+	return db.reopen(f)
+}
+
+// compactTree writes the nodes of the tree with header h to w, which
+// must be positioned at dataOffset, and returns the header of the copy.
+func compactTree(file *dbFile, h header, w io.Writer) (header, error) {
+	c := compactor{
+		file: file,
+		w:    w,
+		end:  dataOffset,
+	}
+	compacted := header{
+		txid:    h.txid,
+		end:     dataOffset,
+		version: h.version,
+	}
+	if h.root == 0 {
+		return compacted, nil
+	}
+	root, err := c.copyNode(h.root)
+	if err == nil {
+		err = c.flush()
+	}
+	compacted.root = root
+	compacted.end = c.end
+	compacted.live = c.end - dataOffset
+	return compacted, err
+}
+
+// compactor copies the reachable nodes of a tree to a new file.
+type compactor struct {
+	file *dbFile
+	w    io.Writer
+	buf  []byte
+	end  int64
+}
+
+func (c *compactor) copyNode(offset int64) (int64, error) {
+	n, err := c.file.readNode(offset)
+	if err != nil {
+		return 0, err
+	}
+	copied := &node{
+		leaf:   n.leaf,
+		keys:   n.keys,
+		values: n.values,
+	}
+	for _, child := range n.children {
+		childOffset, err := c.copyNode(child.offset)
+		if err != nil {
+			return 0, err
+		}
+		copied.children = append(copied.children, childRef{offset: childOffset})
+	}
+	start := len(c.buf)
+	c.buf = copied.encode(c.buf)
+	offset = c.end
+	c.end += int64(len(c.buf) - start)
+	if len(c.buf) >= 1<<20 {
+		return offset, c.flush()
+	}
+	return offset, nil
+}
+
+func (c *compactor) flush() error {
+	_, err := c.w.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// Tx is a transaction.
+type Tx struct {
+	file     *dbFile
+	root     childRef
+	version  uint64
+	writable bool
+	// freed is the size of the records of the nodes
+	// the transaction replaced.
+	freed int64
+}
+
+// Version returns the version of the transaction.
+func (tx *Tx) Version() uint64 {
+	return tx.version
+}
+
+// SetVersion sets the version recorded by the commit.
+func (tx *Tx) SetVersion(version uint64) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	tx.version = version
+	return nil
+}
+
+func (tx *Tx) load(ref childRef) (*node, error) {
+	if ref.node != nil {
+		return ref.node, nil
+	}
+	return tx.file.readNode(ref.offset)
+}
+
+// Get returns the value of a key, or nil if it doesn't exist.
+// The value must not be modified.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if tx.root == (childRef{}) {
+		return nil, nil
+	}
+	n, err := tx.load(tx.root)
+	for err == nil && !n.leaf {
+		n, err = tx.load(n.children[n.childIndex(key)])
+	}
+	if err != nil {
+		return nil, err
+	}
+	i, found := n.search(key)
+	if !found {
+		return nil, nil
+	}
+	return n.values[i], nil
+}
+
+// Ascend calls fn for the keys in [start, end) in order until it returns
+// false. A nil end has no upper bound. Keys and values must not be
+// modified.
+func (tx *Tx) Ascend(start, end []byte, fn func(key, value []byte) bool) error {
+	if tx.root == (childRef{}) {
+		return nil
+	}
+	_, err := tx.ascend(tx.root, start, end, fn)
+	return err
+}
+
+func (tx *Tx) ascend(ref childRef, start, end []byte, fn func(key, value []byte) bool) (bool, error) {
+	n, err := tx.load(ref)
+	if err != nil {
+		return false, err
+	}
+	if !n.leaf {
+		for i := n.childIndex(start); i < len(n.children); i++ {
+			if i > 0 && end != nil && bytes.Compare(n.keys[i], end) >= 0 {
+				return false, nil
+			}
+			more, err := tx.ascend(n.children[i], start, end, fn)
+			if !more || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	i, _ := n.search(start)
+	for ; i < len(n.keys); i++ {
+		if end != nil && bytes.Compare(n.keys[i], end) >= 0 {
+			return false, nil
+		}
+		if !fn(n.keys[i], n.values[i]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// mutableRoot returns a modifiable copy of the root,
+// creating an empty leaf if there is none.
+func (tx *Tx) mutableRoot() (*node, error) {
+	if !tx.writable {
+		return nil, ErrReadOnly
+	}
+	if tx.root == (childRef{}) {
+		tx.root = childRef{node: &node{leaf: true}}
+	}
+	return tx.mutable(&tx.root)
+}
+
+// mutable returns a modifiable copy of a node, replacing the reference.
+func (tx *Tx) mutable(ref *childRef) (*node, error) {
+	if ref.node != nil {
+		return ref.node, nil
+	}
+	n, err := tx.file.readNode(ref.offset)
+	if err != nil {
+		return nil, err
+	}
+	tx.freed += int64(n.recordSize)
+	n = n.clone()
+	*ref = childRef{node: n}
+	return n, nil
+}
+
+// Put sets a key to a value. The key and value are copied.
+func (tx *Tx) Put(key, value []byte) error {
+	root, err := tx.mutableRoot()
+	if err != nil {
+		return err
+	}
+	err = tx.put(root, append([]byte(nil), key...), append([]byte{}, value...))
+	if err != nil {
+		return err
+	}
+	for root.size() > pageSize && len(root.keys) > 1 {
+		right := root.split()
+		root = &node{
+			keys:     [][]byte{root.keys[0], right.keys[0]},
+			children: []childRef{{node: root}, {node: right}},
+		}
+	}
+	tx.root = childRef{node: root}
+	return nil
+}
+
+func (tx *Tx) put(n *node, key, value []byte) error {
+	if n.leaf {
+		i, found := n.search(key)
+		if found {
+			n.values[i] = value
+			return nil
+		}
+		n.keys = append(n.keys, nil)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = key
+		n.values = append(n.values, nil)
+		copy(n.values[i+1:], n.values[i:])
+		n.values[i] = value
+		return nil
+	}
+	i := n.childIndex(key)
+	child, err := tx.mutable(&n.children[i])
+	if err != nil {
+		return err
+	}
+	err = tx.put(child, key, value)
+	if err != nil {
+		return err
+	}
+	if child.size() > pageSize && len(child.keys) > 1 {
+		right := child.split()
+		n.keys = append(n.keys, nil)
+		copy(n.keys[i+2:], n.keys[i+1:])
+		n.keys[i+1] = right.keys[0]
+		n.children = append(n.children, childRef{})
+		copy(n.children[i+2:], n.children[i+1:])
+		n.children[i+1] = childRef{node: right}
+	}
+	return nil
+}
+
+// Delete deletes a key.
+func (tx *Tx) Delete(key []byte) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	if tx.root == (childRef{}) {
+		return nil
+	}
+	// Check first to avoid copying nodes when the key doesn't exist.
+	value, err := tx.Get(key)
+	if err != nil || value == nil {
+		return err
+	}
+	root, err := tx.mutableRoot()
+	if err != nil {
+		return err
+	}
+	err = tx.delete(root, key)
+	if err != nil {
+		return err
+	}
+	for !root.leaf && len(root.children) == 1 {
+		root, err = tx.mutable(&root.children[0])
+		if err != nil {
+			return err
+		}
+	}
+	if len(root.keys) == 0 {
+		tx.root = childRef{}
+		return nil
+	}
+	tx.root = childRef{node: root}
+	return nil
+}
+
+func (tx *Tx) delete(n *node, key []byte) error {
+	if n.leaf {
+		i, found := n.search(key)
+		if found {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			n.values = append(n.values[:i], n.values[i+1:]...)
+		}
+		return nil
+	}
+	i := n.childIndex(key)
+	child, err := tx.mutable(&n.children[i])
+	if err != nil {
+		return err
+	}
+	err = tx.delete(child, key)
+	if err != nil {
+		return err
+	}
+	if child.size() >= minNodeSize || len(n.children) == 1 {
+		return nil
+	}
+	// Merge the child with a sibling.
+	if i == len(n.children)-1 {
+		i--
+	}
+	return tx.merge(n, i)
+}
+
+// merge merges the children of a branch at i and i+1,
+// splitting the result again if it's too large.
+func (tx *Tx) merge(n *node, i int) error {
+	left, err := tx.mutable(&n.children[i])
+	if err != nil {
+		return err
+	}
+	right, err := tx.mutable(&n.children[i+1])
+	if err != nil {
+		return err
+	}
+	if left.leaf {
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+	} else {
+		// The first key of a branch isn't used for searches,
+		// so use the separator from the parent.
+		left.keys = append(left.keys, n.keys[i+1])
+		left.keys = append(left.keys, right.keys[1:]...)
+		left.children = append(left.children, right.children...)
+	}
+	n.keys = append(n.keys[:i+1], n.keys[i+2:]...)
+	n.children = append(n.children[:i+1], n.children[i+2:]...)
+	if left.size() > pageSize && len(left.keys) > 1 {
+		right = left.split()
+		n.keys = append(n.keys, nil)
+		copy(n.keys[i+2:], n.keys[i+1:])
+		n.keys[i+1] = right.keys[0]
+		n.children = append(n.children, childRef{})
+		copy(n.children[i+2:], n.children[i+1:])
+		n.children[i+1] = childRef{node: right}
+	}
+	if len(left.keys) == 0 {
+		// Both children were empty.
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+	}
+	return nil
+}
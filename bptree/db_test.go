@@ -0,0 +1,313 @@
+package bptree
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func tempDB(t *testing.T) (*DB, string, func()) {
+	dir, err := ioutil.TempDir("", "bptree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "db")
+	db, err := Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, path, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// checkContents compares the contents of a database with a map.
+func checkContents(t *testing.T, db *DB, expected map[string]string) {
+	t.Helper()
+	keys := []string{}
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	err := db.View(func(tx *Tx) error {
+		got := []string{}
+		err := tx.Ascend(nil, nil, func(key, value []byte) bool {
+			if string(value) != expected[string(key)] {
+				t.Errorf("expected %s=%q, got %q", key, expected[string(key)], value)
+			}
+			got = append(got, string(key))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(got) != fmt.Sprint(keys) {
+			t.Fatalf("expected %d keys, got %d", len(keys), len(got))
+		}
+		for _, key := range keys {
+			value, err := tx.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			if string(value) != expected[key] {
+				t.Fatalf("expected %s=%q, got %q", key, expected[key], value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB(t *testing.T) {
+	db, path, cleanup := tempDB(t)
+	defer cleanup()
+
+	rng := rand.New(rand.NewSource(1))
+	expected := map[string]string{}
+	for i := 1; i <= 200; i++ {
+		err := db.Update(func(tx *Tx) error {
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("key%05d", rng.Intn(5000))
+				if rng.Intn(3) == 0 {
+					delete(expected, key)
+					if err := tx.Delete([]byte(key)); err != nil {
+						return err
+					}
+					continue
+				}
+				value := bytes.Repeat([]byte{byte('a' + j%26)}, rng.Intn(200))
+				expected[key] = string(value)
+				if err := tx.Put([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			return tx.SetVersion(uint64(i))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkContents(t, db, expected)
+
+	// A failed transaction isn't committed.
+	failed := fmt.Errorf("failed")
+	err := db.Update(func(tx *Tx) error {
+		tx.Put([]byte("uncommitted"), []byte("x"))
+		tx.SetVersion(1000)
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("expected the transaction's error, got %v", err)
+	}
+
+	db.Close()
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, expected)
+	if version, _ := db.Version(); version != 200 {
+		t.Fatalf("expected version 200, got %d", version)
+	}
+
+	// Delete everything in ranges.
+	err = db.Update(func(tx *Tx) error {
+		keys := [][]byte{}
+		tx.Ascend([]byte("key01"), []byte("key04"), func(key, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+		for _, key := range keys {
+			if err := tx.Delete(key); err != nil {
+				return err
+			}
+			delete(expected, string(key))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, expected)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, garbage, err := db.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live+garbage != info.Size()-dataOffset || garbage == 0 {
+		t.Fatalf("expected garbage in a %d byte file, got %d live and %d garbage bytes", info.Size(), live, garbage)
+	}
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.Size() >= info.Size() {
+		t.Fatalf("expected compaction to shrink %d bytes, got %d", info.Size(), compacted.Size())
+	}
+	// Compaction only keeps the live records. They can be smaller
+	// after compaction, since offsets are encoded as varints.
+	if compacted.Size()-dataOffset > live {
+		t.Fatalf("expected at most %d live bytes after compaction, got %d", live, compacted.Size()-dataOffset)
+	}
+	if _, garbage, _ = db.Usage(); garbage != 0 {
+		t.Fatalf("expected no garbage after compaction, got %d bytes", garbage)
+	}
+	checkContents(t, db, expected)
+	if version, _ := db.Version(); version != 200 {
+		t.Fatalf("expected version 200, got %d", version)
+	}
+}
+
+func TestDBUnfinishedCommit(t *testing.T) {
+	db, path, cleanup := tempDB(t)
+	defer cleanup()
+
+	for i := 1; i <= 2; i++ {
+		err := db.Update(func(tx *Tx) error {
+			tx.Put([]byte(fmt.Sprint("key", i)), []byte("value"))
+			return tx.SetVersion(uint64(i))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// Corrupt the header of the last commit, which is in slot 0
+	// because it has an even transaction ID, as if it was only
+	// partially written.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff}, headerSlotSize-20)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := db.Version(); version != 1 {
+		t.Fatalf("expected version 1, got %d", version)
+	}
+	checkContents(t, db, map[string]string{"key1": "value"})
+}
+
+func TestDBSnapshot(t *testing.T) {
+	db, _, cleanup := tempDB(t)
+	defer cleanup()
+
+	expected := map[string]string{}
+	err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprint("key", i)
+			expected[key] = fmt.Sprint(i)
+			if err := tx.Put([]byte(key), []byte(expected[key])); err != nil {
+				return err
+			}
+		}
+		return tx.SetVersion(1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+
+	// Commits after the snapshot aren't in it.
+	err = db.Update(func(tx *Tx) error {
+		tx.Put([]byte("after"), []byte("snapshot"))
+		return tx.SetVersion(2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, _, cleanupRestored := tempDB(t)
+	defer cleanupRestored()
+	if err = restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, restored, expected)
+	if version, _ := restored.Version(); version != 1 {
+		t.Fatalf("expected version 1, got %d", version)
+	}
+
+	if err = restored.Restore(bytes.NewReader([]byte("not a database"))); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	checkContents(t, restored, expected)
+}
+
+func TestDBSnapshotSize(t *testing.T) {
+	db, path, cleanup := tempDB(t)
+	defer cleanup()
+
+	put := func(version uint64) {
+		err := db.Update(func(tx *Tx) error {
+			for i := 0; i < 100; i++ {
+				if err := tx.Put([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprintf("%03d", version))); err != nil {
+					return err
+				}
+			}
+			return tx.SetVersion(version)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshotSize := func() int64 {
+		snapshot, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snapshot.Close()
+		return snapshot.Size()
+	}
+
+	put(1)
+	size := snapshotSize()
+	// Overwriting the same keys grows the file,
+	// but not snapshots of it.
+	for version := uint64(2); version <= 100; version++ {
+		put(version)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() < 50*size {
+		t.Fatalf("expected overwrites to grow the file, got %d bytes", info.Size())
+	}
+	if got := snapshotSize(); got > size+size/10 {
+		t.Fatalf("expected a snapshot of about %d bytes, got %d", size, got)
+	}
+
+	// Closed snapshots don't leave files behind.
+	names, err := filepath.Glob(path + ".snapshot-*")
+	if err != nil || len(names) > 0 {
+		t.Fatalf("expected no snapshot files, got %v (%v)", names, err)
+	}
+}
@@ -0,0 +1,233 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// File format:
+//
+//	header slot 0   headerSlotSize bytes
+//	header slot 1   headerSlotSize bytes
+//	node records    (uint32 payload length, uint32 CRC-32 of payload, payload)
+//
+// Records are only appended. A commit appends the modified nodes, syncs,
+// and then writes the header slot for its transaction ID and syncs again,
+// so the slot with the highest valid transaction ID always refers to a
+// complete tree. Anything after the end recorded in that slot is left
+// over from a commit that didn't finish.
+//
+// Format 2 headers also record the size of the records reachable from
+// the root. Format 1 headers are read as if every record is reachable.
+const (
+	fileMagic      = "RIGBTREE"
+	fileFormat     = 2
+	headerSlotSize = 64
+	dataOffset     = 2 * headerSlotSize
+)
+
+// maxCachedNodes is the number of decoded nodes cached per file.
+const maxCachedNodes = 4096
+
+// header is the committed state of a file.
+type header struct {
+	txid    uint64
+	root    int64 // 0 for an empty tree
+	end     int64
+	version uint64
+	// live is the size of the records reachable from the root.
+	live int64
+}
+
+func (h header) encode() []byte {
+	buf := make([]byte, headerSlotSize)
+	copy(buf, fileMagic)
+	binary.BigEndian.PutUint32(buf[8:], fileFormat)
+	binary.BigEndian.PutUint64(buf[12:], h.txid)
+	binary.BigEndian.PutUint64(buf[20:], uint64(h.root))
+	binary.BigEndian.PutUint64(buf[28:], uint64(h.end))
+	binary.BigEndian.PutUint64(buf[36:], h.version)
+	binary.BigEndian.PutUint64(buf[44:], uint64(h.live))
+	binary.BigEndian.PutUint32(buf[52:], crc32.ChecksumIEEE(buf[:52]))
+	return buf
+}
+
+func decodeHeader(buf []byte) (header, bool) {
+	if string(buf[:8]) != fileMagic {
+		return header{}, false
+	}
+	h := header{
+		txid:    binary.BigEndian.Uint64(buf[12:]),
+		root:    int64(binary.BigEndian.Uint64(buf[20:])),
+		end:     int64(binary.BigEndian.Uint64(buf[28:])),
+		version: binary.BigEndian.Uint64(buf[36:]),
+	}
+	switch binary.BigEndian.Uint32(buf[8:]) {
+	case 1:
+		if binary.BigEndian.Uint32(buf[44:]) != crc32.ChecksumIEEE(buf[:44]) {
+			return header{}, false
+		}
+		h.live = h.end - dataOffset
+	case fileFormat:
+		if binary.BigEndian.Uint32(buf[52:]) != crc32.ChecksumIEEE(buf[:52]) {
+			return header{}, false
+		}
+		h.live = int64(binary.BigEndian.Uint64(buf[44:]))
+	default:
+		return header{}, false
+	}
+	if h.end < dataOffset || h.root >= h.end || (h.root != 0 && h.root < dataOffset) ||
+		h.live < 0 || h.live > h.end-dataOffset {
+		return header{}, false
+	}
+	return h, true
+}
+
+// headerBytes returns both header slots set to h.
+func headerBytes(h header) []byte {
+	slot := h.encode()
+	return append(append([]byte(nil), slot...), slot...)
+}
+
+// readHeader returns the newest valid header of a file.
+func readHeader(f *os.File) (header, error) {
+	buf := make([]byte, dataOffset)
+	_, err := f.ReadAt(buf, 0)
+	if err != nil {
+		return header{}, ErrCorrupt
+	}
+	h0, ok0 := decodeHeader(buf[:headerSlotSize])
+	h1, ok1 := decodeHeader(buf[headerSlotSize:])
+	switch {
+	case ok0 && (!ok1 || h0.txid > h1.txid):
+		return h0, nil
+	case ok1:
+		return h1, nil
+	}
+	return header{}, ErrCorrupt
+}
+
+// dbFile is an open database file. It is reference counted
+// because readers can keep using a file after it is replaced.
+type dbFile struct {
+	f    *os.File
+	refs int32
+
+	cacheLock sync.Mutex
+	cache     map[int64]*node
+}
+
+func newDBFile(f *os.File) *dbFile {
+	return &dbFile{
+		f:     f,
+		refs:  1,
+		cache: map[int64]*node{},
+	}
+}
+
+func (df *dbFile) acquire() {
+	atomic.AddInt32(&df.refs, 1)
+}
+
+func (df *dbFile) release() {
+	if atomic.AddInt32(&df.refs, -1) == 0 {
+		df.f.Close()
+	}
+}
+
+// readNode returns the node written at an offset.
+func (df *dbFile) readNode(offset int64) (*node, error) {
+	df.cacheLock.Lock()
+	n, ok := df.cache[offset]
+	df.cacheLock.Unlock()
+	if ok {
+		return n, nil
+	}
+	var recordHeader [recordHeaderSize]byte
+	_, err := df.f.ReadAt(recordHeader[:], offset)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(recordHeader[:]))
+	_, err = df.f.ReadAt(payload, offset+recordHeaderSize)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(recordHeader[4:]) {
+		return nil, ErrCorrupt
+	}
+	n, err = decodeNode(offset, payload)
+	if err != nil {
+		return nil, err
+	}
+	df.cacheNode(n)
+	return n, nil
+}
+
+func (df *dbFile) cacheNode(n *node) {
+	df.cacheLock.Lock()
+	defer df.cacheLock.Unlock()
+	if len(df.cache) >= maxCachedNodes {
+		// Evict about half of the nodes.
+		for offset := range df.cache {
+			delete(df.cache, offset)
+			if len(df.cache) < maxCachedNodes/2 {
+				break
+			}
+		}
+	}
+	df.cache[n.offset] = n
+}
+
+// createFile writes a file with the contents of fill, which is called
+// with the file positioned at dataOffset and returns the header, and
+// then atomically replaces path with it.
+func createFile(path string, fill func(f *os.File) (header, error)) (*os.File, error) {
+	tmp, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if _, err = tmp.Seek(dataOffset, 0); err != nil {
+		return fail(err)
+	}
+	h, err := fill(tmp)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err = tmp.WriteAt(headerBytes(h), 0); err != nil {
+		return fail(err)
+	}
+	if err = tmp.Truncate(h.end); err != nil {
+		return fail(err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fail(err)
+	}
+	if err = syncDir(filepath.Dir(path)); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// syncDir syncs a directory so that renames in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,212 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sort"
+)
+
+// Nodes are split when their encoded size is larger than pageSize,
+// and merged with a sibling when it's smaller than minNodeSize.
+const (
+	pageSize    = 4096
+	minNodeSize = pageSize / 4
+)
+
+// recordHeaderSize is the size of the length and
+// checksum written before each encoded node.
+const recordHeaderSize = 8
+
+// ErrCorrupt is returned when a database file can't be decoded.
+var ErrCorrupt = errors.New("bptree: corrupt file")
+
+// node is a leaf or branch node. Nodes that were read from the file or
+// written by a commit are shared and must not be modified; transactions
+// modify copies, which have a zero offset until they are written.
+//
+// A branch has a child for each key, and keys[i] is less than or equal
+// to the keys in children[i] and greater than the keys in children[i-1].
+// keys[0] is not used for searches.
+type node struct {
+	offset int64
+	// recordSize is the size of the node's record,
+	// if it was read from the file or written.
+	recordSize int
+	leaf       bool
+	keys       [][]byte
+	values     [][]byte
+	children   []childRef
+}
+
+// childRef refers to a child by its offset in the file,
+// or to a modified child that hasn't been written yet.
+type childRef struct {
+	offset int64
+	node   *node
+}
+
+func (n *node) clone() *node {
+	return &node{
+		leaf:     n.leaf,
+		keys:     append([][]byte(nil), n.keys...),
+		values:   append([][]byte(nil), n.values...),
+		children: append([]childRef(nil), n.children...),
+	}
+}
+
+// search returns the index of the first key greater than or equal to key.
+func (n *node) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) >= 0
+	})
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+// childIndex returns the index of the child of a branch that
+// would contain key.
+func (n *node) childIndex(key []byte) int {
+	i := sort.Search(len(n.keys)-1, func(i int) bool {
+		return bytes.Compare(n.keys[i+1], key) > 0
+	})
+	return i
+}
+
+func (n *node) size() int {
+	size := 1 + binary.MaxVarintLen64
+	for i, key := range n.keys {
+		size += binary.MaxVarintLen64 + len(key)
+		if n.leaf {
+			size += binary.MaxVarintLen64 + len(n.values[i])
+		} else {
+			size += binary.MaxVarintLen64
+		}
+	}
+	return size
+}
+
+// split moves the upper half of a node's entries by size into a new node.
+func (n *node) split() *node {
+	half := n.size() / 2
+	size := 0
+	i := 0
+	for ; i < len(n.keys)-1; i++ {
+		size += len(n.keys[i])
+		if n.leaf {
+			size += len(n.values[i])
+		}
+		if size >= half && i > 0 {
+			break
+		}
+	}
+	if i == 0 {
+		i = 1
+	}
+	right := &node{leaf: n.leaf}
+	right.keys = append(right.keys, n.keys[i:]...)
+	n.keys = n.keys[:i:i]
+	if n.leaf {
+		right.values = append(right.values, n.values[i:]...)
+		n.values = n.values[:i:i]
+	} else {
+		right.children = append(right.children, n.children[i:]...)
+		n.children = n.children[:i:i]
+	}
+	return right
+}
+
+// encode appends the record for a node. Its children must
+// already have been written.
+func (n *node) encode(buf []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize)...)
+	var flags byte
+	if n.leaf {
+		flags = 1
+	}
+	buf = append(buf, flags)
+	buf = appendUvarint(buf, uint64(len(n.keys)))
+	for i, key := range n.keys {
+		buf = appendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		if n.leaf {
+			buf = appendUvarint(buf, uint64(len(n.values[i])))
+			buf = append(buf, n.values[i]...)
+		} else {
+			buf = appendUvarint(buf, uint64(n.children[i].offset))
+		}
+	}
+	payload := buf[start+recordHeaderSize:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	return append(buf, b[:n]...)
+}
+
+// decodeNode decodes the payload of a node record.
+func decodeNode(offset int64, payload []byte) (*node, error) {
+	if len(payload) == 0 {
+		return nil, ErrCorrupt
+	}
+	n := &node{
+		offset:     offset,
+		recordSize: recordHeaderSize + len(payload),
+		leaf:       payload[0] == 1,
+	}
+	d := decoder{buf: payload[1:]}
+	count := d.uvarint()
+	if count > uint64(len(payload)) {
+		return nil, ErrCorrupt
+	}
+	n.keys = make([][]byte, 0, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		n.keys = append(n.keys, d.bytes())
+		if n.leaf {
+			n.values = append(n.values, d.bytes())
+		} else {
+			n.children = append(n.children, childRef{offset: int64(d.uvarint())})
+		}
+	}
+	if d.err != nil || len(d.buf) != 0 || (!n.leaf && count == 0) {
+		return nil, ErrCorrupt
+	}
+	return n, nil
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrCorrupt
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = ErrCorrupt
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
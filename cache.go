@@ -0,0 +1,419 @@
+package rig
+
+import (
+	"container/list"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheMetaSuffix = ".meta"
+	cacheTempPrefix = ".download-"
+)
+
+// CachingObjectStore keeps local copies of snapshots and log records,
+// which are never modified after they are written, so restarting a
+// service doesn't download them again. Other objects, like LATEST, are
+// always read from the backing store.
+//
+// If the backing store implements Stater, cached objects are checked
+// against the size and ETag of the stored object before they are used.
+// Otherwise they are only checked against the size they were cached with.
+type CachingObjectStore struct {
+	store    ObjectStore
+	dir      string
+	maxBytes int64
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// lru has the most recently used entries at the front.
+	lru  *list.List
+	size int64
+}
+
+type cacheEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag,omitempty"`
+}
+
+var _ ObjectStore = &CachingObjectStore{}
+
+// NewCachingObjectStore returns a store that caches objects from store
+// in dir, using up to maxBytes. Objects cached by an earlier process
+// in the same directory are reused.
+func NewCachingObjectStore(store ObjectStore, dir string, maxBytes int64) (*CachingObjectStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	c := &CachingObjectStore{
+		store:    store,
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+	err = c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.evict()
+	c.lock.Unlock()
+	return c, nil
+}
+
+// load adds the objects already in the cache directory,
+// ordered by when they were last used.
+func (c *CachingObjectStore) load() error {
+	type loaded struct {
+		entry   cacheEntry
+		modTime time.Time
+	}
+	found := []loaded{}
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), cacheTempPrefix) {
+			// Left over from a download that didn't finish.
+			os.Remove(path)
+			return nil
+		}
+		if !strings.HasSuffix(path, cacheMetaSuffix) {
+			return nil
+		}
+		dataPath := strings.TrimSuffix(path, cacheMetaSuffix)
+		var entry cacheEntry
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(b, &entry)
+		}
+		var dataInfo os.FileInfo
+		if err == nil {
+			dataInfo, err = os.Stat(dataPath)
+		}
+		if err != nil || dataInfo.Size() != entry.Size || c.path(entry.Name) != dataPath {
+			os.Remove(dataPath)
+			os.Remove(path)
+			return nil
+		}
+		found = append(found, loaded{entry: entry, modTime: dataInfo.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.After(found[j].modTime)
+	})
+	for _, l := range found {
+		entry := l.entry
+		c.entries[entry.Name] = c.lru.PushBack(&entry)
+		c.size += entry.Size
+	}
+	return nil
+}
+
+// cacheable returns true for the names of immutable objects.
+func cacheable(name string) bool {
+	switch filepath.Base(filepath.Dir(name)) {
+	case "SNAPSHOT", "LOG":
+		return true
+	}
+	return false
+}
+
+func (c *CachingObjectStore) path(name string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(name))
+}
+
+func (c *CachingObjectStore) GetObject(name string) (io.ReadCloser, error) {
+	if !cacheable(name) {
+		return c.store.GetObject(name)
+	}
+	info, validated, err := c.stat(name)
+	if err != nil {
+		if err == errDoesNotExist {
+			c.remove(name)
+		}
+		return nil, err
+	}
+	r, ok := c.open(name, info, validated)
+	if ok {
+		return r, nil
+	}
+	return c.download(name, info, validated)
+}
+
+// stat returns the size and ETag of an object if the backing
+// store implements Stater.
+func (c *CachingObjectStore) stat(name string) (ObjectInfo, bool, error) {
+	stater, ok := c.store.(Stater)
+	if !ok {
+		return ObjectInfo{}, false, nil
+	}
+	info, err := stater.StatObject(name)
+	return info, err == nil, err
+}
+
+// open returns the cached copy of an object if it matches info.
+func (c *CachingObjectStore) open(name string, info ObjectInfo, validated bool) (io.ReadCloser, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if validated && (entry.Size != info.Size || (entry.ETag != "" && info.ETag != "" && entry.ETag != info.ETag)) {
+		c.removeLocked(name)
+		return nil, false
+	}
+	f, err := os.Open(c.path(name))
+	if err != nil {
+		c.removeLocked(name)
+		return nil, false
+	}
+	if validated && entry.ETag == "" && info.ETag != "" {
+		// Objects cached by PutObject don't have an ETag yet.
+		entry.ETag = info.ETag
+		c.writeMeta(entry)
+	}
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+	c.lru.MoveToFront(element)
+	return f, true
+}
+
+// download reads an object from the backing store into the cache.
+// If the object can't be cached, it's read from the backing store
+// again instead.
+func (c *CachingObjectStore) download(name string, info ObjectInfo, validated bool) (io.ReadCloser, error) {
+	r, err := c.store.GetObject(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	tmp, size, err := c.writeTemp(r)
+	if err != nil {
+		if _, ok := err.(cacheError); ok {
+			return c.store.GetObject(name)
+		}
+		return nil, err
+	}
+	if validated && size != info.Size {
+		// The object was replaced while it was downloaded.
+		os.Remove(tmp)
+		return c.store.GetObject(name)
+	}
+	entry := &cacheEntry{Name: name, Size: size, ETag: info.ETag}
+	f, err := c.add(entry, tmp)
+	if err != nil {
+		return c.store.GetObject(name)
+	}
+	return f, nil
+}
+
+// cacheError wraps errors from writing to the cache directory,
+// as opposed to reading from the backing store.
+type cacheError struct {
+	err error
+}
+
+func (e cacheError) Error() string {
+	return e.err.Error()
+}
+
+// writeTemp copies r to a temporary file in the cache directory.
+func (c *CachingObjectStore) writeTemp(r io.Reader) (string, int64, error) {
+	f, err := ioutil.TempFile(c.dir, cacheTempPrefix)
+	if err != nil {
+		return "", 0, cacheError{err}
+	}
+	size, err := io.Copy(cacheWriter{f}, r)
+	closeErr := f.Close()
+	if err == nil && closeErr != nil {
+		err = cacheError{closeErr}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), size, nil
+}
+
+// cacheWriter marks write errors as cacheErrors.
+type cacheWriter struct {
+	f *os.File
+}
+
+func (w cacheWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		err = cacheError{err}
+	}
+	return n, err
+}
+
+// add moves a downloaded file into the cache and returns it opened.
+func (c *CachingObjectStore) add(entry *cacheEntry, tmp string) (*os.File, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(entry.Name)
+	path := c.path(entry.Name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = c.writeMeta(entry)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(path)
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[entry.Name] = c.lru.PushFront(entry)
+	c.size += entry.Size
+	// Objects larger than the cache are still returned,
+	// since removing an open file doesn't affect readers.
+	c.evict()
+	return f, nil
+}
+
+func (c *CachingObjectStore) writeMeta(entry *cacheEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(entry.Name)+cacheMetaSuffix, b, 0644)
+}
+
+// evict removes the least recently used objects until the
+// cache fits in maxBytes. The caller must hold c.lock.
+func (c *CachingObjectStore) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).Name)
+	}
+}
+
+func (c *CachingObjectStore) remove(name string) {
+	c.lock.Lock()
+	c.removeLocked(name)
+	c.lock.Unlock()
+}
+
+func (c *CachingObjectStore) removeLocked(name string) {
+	element, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.lru.Remove(element)
+	delete(c.entries, name)
+	c.size -= element.Value.(*cacheEntry).Size
+	os.Remove(c.path(name) + cacheMetaSuffix)
+	os.Remove(c.path(name))
+}
+
+// PutObject writes an object to the backing store,
+// and caches it if it's immutable.
+func (c *CachingObjectStore) PutObject(name string, data io.ReadSeeker, size int64) error {
+	err := c.store.PutObject(name, data, size)
+	if err != nil || !cacheable(name) {
+		c.remove(name)
+		return err
+	}
+	_, err = data.Seek(0, io.SeekStart)
+	if err != nil {
+		// The object is stored, it just can't be cached.
+		c.remove(name)
+		return nil
+	}
+	tmp, written, err := c.writeTemp(data)
+	if err != nil {
+		c.remove(name)
+		return nil
+	}
+	if written != size {
+		os.Remove(tmp)
+		c.remove(name)
+		return nil
+	}
+	f, err := c.add(&cacheEntry{Name: name, Size: size}, tmp)
+	if err == nil {
+		f.Close()
+	}
+	return nil
+}
+
+func (c *CachingObjectStore) DeleteObject(name string) error {
+	c.remove(name)
+	return c.store.DeleteObject(name)
+}
+
+// CreateDirectory creates a directory in the backing store
+// if it implements DirectoryCreator.
+func (c *CachingObjectStore) CreateDirectory(path string) error {
+	if creator, ok := c.store.(DirectoryCreator); ok {
+		return creator.CreateDirectory(path)
+	}
+	return nil
+}
+
+// ListObjects lists objects in the backing store. It returns
+// ErrListUnsupported if the backing store doesn't implement Lister.
+func (c *CachingObjectStore) ListObjects(dir string) ([]string, error) {
+	if lister, ok := c.store.(Lister); ok {
+		return lister.ListObjects(dir)
+	}
+	return nil, ErrListUnsupported
+}
+
+// GetObjectETag reads an object from the backing store if it
+// implements ConditionalWriter, without caching it.
+func (c *CachingObjectStore) GetObjectETag(name string) (io.ReadCloser, string, error) {
+	if writer, ok := c.store.(ConditionalWriter); ok {
+		return writer.GetObjectETag(name)
+	}
+	return nil, "", ErrConditionalUnsupported
+}
+
+// PutObjectIfMatch writes an object to the backing store if it
+// implements ConditionalWriter, without caching it.
+func (c *CachingObjectStore) PutObjectIfMatch(name string, data io.ReadSeeker, size int64, etag string) error {
+	writer, ok := c.store.(ConditionalWriter)
+	if !ok {
+		return ErrConditionalUnsupported
+	}
+	c.remove(name)
+	return writer.PutObjectIfMatch(name, data, size, etag)
+}
+
+// PrepareRecovery prepares the backing store for recovery
+// if it implements RecoveryPreparer.
+func (c *CachingObjectStore) PrepareRecovery(prefix string) error {
+	if preparer, ok := c.store.(RecoveryPreparer); ok {
+		return preparer.PrepareRecovery(prefix)
+	}
+	return nil
+}
+
+// Size returns the number of bytes cached.
+func (c *CachingObjectStore) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
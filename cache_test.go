@@ -0,0 +1,114 @@
+package rig
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingObjectStore counts the objects read from a file object store.
+type countingObjectStore struct {
+	ObjectStore
+	gets map[string]int
+}
+
+func (o *countingObjectStore) GetObject(name string) (io.ReadCloser, error) {
+	o.gets[name]++
+	return o.ObjectStore.GetObject(name)
+}
+
+func (o *countingObjectStore) StatObject(name string) (ObjectInfo, error) {
+	return o.ObjectStore.(Stater).StatObject(name)
+}
+
+func readObject(t *testing.T, store ObjectStore, name string) string {
+	t.Helper()
+	r, err := store.GetObject(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func putObject(t *testing.T, store ObjectStore, name, data string) {
+	t.Helper()
+	err := store.PutObject(name, bytes.NewReader([]byte(data)), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachingObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileObjectStore(filepath.Join(dir, "store"))
+	backing := &countingObjectStore{
+		ObjectStore: store,
+		gets:        map[string]int{},
+	}
+	if err = createDirectories(store, "svc"); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	cache, err := NewCachingObjectStore(backing, cacheDir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log1 := logRecordName("svc", 1)
+	log2 := logRecordName("svc", 2)
+	latest := latestObjectName("svc")
+	putObject(t, cache, log1, "aaaa")
+	putObject(t, backing, log2, "bbbb")
+	putObject(t, cache, latest, "1")
+
+	// A restarted process reuses the cached objects.
+	cache, err = NewCachingObjectStore(backing, cacheDir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got := readObject(t, cache, log1); got != "aaaa" {
+			t.Fatalf("unexpected contents %q", got)
+		}
+		if got := readObject(t, cache, log2); got != "bbbb" {
+			t.Fatalf("unexpected contents %q", got)
+		}
+		if got := readObject(t, cache, latest); got != "1" {
+			t.Fatalf("unexpected contents %q", got)
+		}
+	}
+	if backing.gets[log1] != 0 || backing.gets[log2] != 1 || backing.gets[latest] != 2 {
+		t.Fatalf("unexpected reads from the backing store: %v", backing.gets)
+	}
+
+	// A cached object that doesn't match the stored one isn't used.
+	putObject(t, backing, log1, "aaaaa")
+	if got := readObject(t, cache, log1); got != "aaaaa" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if backing.gets[log1] != 1 {
+		t.Fatalf("expected %s to be read from the backing store", log1)
+	}
+	if size := cache.Size(); size > 10 {
+		t.Fatalf("expected the cache to be evicted to 10 bytes, got %d", size)
+	}
+
+	if err = backing.DeleteObject(log2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.GetObject(log2); !IsNotExist(err) {
+		t.Fatalf("expected a missing object, got %v", err)
+	}
+}
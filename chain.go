@@ -0,0 +1,301 @@
+package rig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	// ErrChainBroken means a log record doesn't have the hash of the
+	// record before it, so a record was altered or removed.
+	ErrChainBroken = errors.New("rig: log record doesn't follow the previous one")
+	// ErrInvalidSignature means the signature of a log
+	// record doesn't match the verification key.
+	ErrInvalidSignature = errors.New("rig: invalid log record signature")
+)
+
+// ChainError is returned when a log record fails verification.
+type ChainError struct {
+	// Version is the version of the log record.
+	Version uint64
+	// Err is ErrChainBroken or ErrInvalidSignature.
+	Err error
+}
+
+func (e ChainError) Error() string {
+	return fmt.Sprintf("rig: log record %016x: %v", e.Version, e.Err)
+}
+
+// SetSigningKey makes the service sign the log records it writes with
+// key, so they can be verified with Archive.VerifyChain and the public
+// key. It also sets the public key as the verification key, like
+// SetVerifyKey. Call it before Recover.
+func (rs *RiggedService) SetSigningKey(key ed25519.PrivateKey) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.signingKey = key
+	rs.verifyKey = key.Public().(ed25519.PublicKey)
+}
+
+// SetVerifyKey makes Recover and followers check that every log record
+// they read is signed with the key for publicKey. Services that don't
+// write log records only need the public key, so the private key can be
+// kept on the nodes that lead. Recover only reads the log records after
+// the latest snapshot, so to start signing an existing log, take a
+// snapshot before restarting with the keys set. Call it before Recover.
+func (rs *RiggedService) SetVerifyKey(publicKey ed25519.PublicKey) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.verifyKey = publicKey
+}
+
+// untrusted returns true for errors that mean the log or the
+// state of the service can't be trusted, which stop followers.
+func untrusted(err error) bool {
+	switch err.(type) {
+	case ErrDivergence, ChainError:
+		return true
+	}
+	return false
+}
+
+func hashLogRecord(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// signLogBatch sets the signature of a batch.
+func signLogBatch(batch *logBatch, key ed25519.PrivateKey) error {
+	batch.Signature = nil
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	batch.Signature = ed25519.Sign(key, payload)
+	return nil
+}
+
+// validSignature returns true if a batch is signed
+// with the key for publicKey.
+func validSignature(batch logBatch, publicKey ed25519.PublicKey) bool {
+	signature := batch.Signature
+	batch.Signature = nil
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return false
+	}
+	return len(signature) == ed25519.SignatureSize && ed25519.Verify(publicKey, payload, signature)
+}
+
+// readLogBatch reads a log record for a version and checks it with
+// verifyLogBatch. It returns the batch and the hash of the record.
+// The caller must hold rs.lock.
+func (rs *RiggedService) readLogBatch(name string, version uint64) (logBatch, []byte, error) {
+	r, err := rs.objectStore.GetObject(name)
+	if err != nil {
+		return logBatch{}, nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return logBatch{}, nil, err
+	}
+	batch, err := decodeLogBatch(bytes.NewReader(data))
+	if err != nil {
+		return batch, nil, err
+	}
+	return batch, hashLogRecord(data), rs.verifyLogBatch(version, batch)
+}
+
+// verifyLogBatch checks that a log record follows the chain head, if
+// it's known, and is signed if there's a verification key. Records
+// written before the log was chained aren't checked against the chain
+// head, and can't be signed. The caller must hold rs.lock.
+func (rs *RiggedService) verifyLogBatch(version uint64, batch logBatch) error {
+	chained := batch.Version != 0
+	if chained && (batch.Version != version || (rs.chainHead != nil && !bytes.Equal(batch.Previous, rs.chainHead))) {
+		return ChainError{Version: version, Err: ErrChainBroken}
+	}
+	if rs.verifyKey == nil {
+		return nil
+	}
+	// Every record has to be signed, or removing the signatures
+	// from the first signed record and the ones after it would
+	// make them look like records written before signing started.
+	if !chained || !validSignature(batch, rs.verifyKey) {
+		return ChainError{Version: version, Err: ErrInvalidSignature}
+	}
+	return nil
+}
+
+// advanceChain makes the hash of a log record that was applied the
+// chain head. The caller must hold rs.lock.
+func (rs *RiggedService) advanceChain(batch logBatch, hash []byte) {
+	rs.chainHead = hash
+	if batch.Signature != nil {
+		rs.chainSigned = true
+	}
+}
+
+// loadChainHead makes the log record containing the current version the
+// chain head, for services that recover their own state instead of
+// restoring a snapshot, and followers that applied the record from a
+// ReplicaClient. It returns ErrListUnsupported if the object store can't
+// list the log, since the next log record would start a new chain, which
+// followers and VerifyChain would report as broken. The caller must hold
+// rs.lock.
+func (rs *RiggedService) loadChainHead(archive *Archive) error {
+	if rs.currentVersion == 0 {
+		// The next log record starts the chain.
+		return nil
+	}
+	records, err := archive.LogRecords()
+	if err != nil {
+		return err
+	}
+	name := ""
+	for _, record := range records {
+		if record.Version > rs.currentVersion {
+			break
+		}
+		if record.Timestamp == 0 {
+			name = record.Name
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	data, err := archive.readObject(name)
+	if err != nil {
+		return err
+	}
+	batch, err := decodeLogBatch(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	rs.advanceChain(batch, hashLogRecord(data))
+	return nil
+}
+
+// ChainReport describes the result of Archive.VerifyChain.
+type ChainReport struct {
+	// Batches is the number of log records checked.
+	Batches int
+	// LastVersion is the last version in the log.
+	LastVersion uint64
+	// Head is the hash of the last log record. Auditors can record it
+	// to detect log records removed from the end later.
+	Head []byte
+
+	// Broken are the versions of log records that don't follow the
+	// record before them, because it was altered or removed or they were.
+	Broken []uint64
+	// Unsigned and BadSignatures are the versions of log records without
+	// a signature or with an invalid one, if a public key was given.
+	Unsigned      []uint64
+	BadSignatures []uint64
+	// SnapshotMismatches are the versions of snapshots whose
+	// chain head doesn't match the log.
+	SnapshotMismatches []uint64
+	// Undecodable are the names of log records that could not be read.
+	Undecodable []string
+}
+
+// OK returns true if the report found no problems.
+func (r *ChainReport) OK() bool {
+	return len(r.Broken) == 0 && len(r.Unsigned) == 0 && len(r.BadSignatures) == 0 &&
+		len(r.SnapshotMismatches) == 0 && len(r.Undecodable) == 0
+}
+
+// VerifyChain checks that every log record has the hash of the one
+// before it, starting with the oldest one, and that snapshots have the
+// hash of the log record they were taken after. If publicKey isn't nil,
+// it also checks that the log records are signed with its key.
+func (a *Archive) VerifyChain(publicKey ed25519.PublicKey) (*ChainReport, error) {
+	report := &ChainReport{}
+	records, err := a.LogRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	// hashes has the hash of the log record ending at each version.
+	hashes := map[uint64][]byte{}
+	var first, next uint64
+	var previous []byte
+	previousChained := false
+	for i := 0; i < len(records); {
+		// Timestamped copies sort after the record they duplicate, so use the
+		// first record for a version that can be read.
+		version := records[i].Version
+		var data []byte
+		for ; i < len(records) && records[i].Version == version; i++ {
+			if data != nil {
+				continue
+			}
+			data, err = a.readObject(records[i].Name)
+			if err != nil && !IsNotExist(err) {
+				return nil, err
+			}
+		}
+		if data == nil {
+			// Deleted since it was listed.
+			continue
+		}
+		batch, err := decodeLogBatch(bytes.NewReader(data))
+		if err != nil {
+			report.Undecodable = append(report.Undecodable, logRecordName(a.prefix, version))
+			continue
+		}
+		report.Batches++
+		chained := batch.Version != 0
+		if report.Batches == 1 {
+			first = version
+		} else if version != next || (chained && batch.Version != version) || (!chained && previousChained) ||
+			(chained && (batch.Previous != nil || previousChained) && !bytes.Equal(batch.Previous, previous)) {
+			report.Broken = append(report.Broken, version)
+		}
+		if publicKey != nil {
+			if batch.Signature == nil {
+				report.Unsigned = append(report.Unsigned, version)
+			} else if !validSignature(batch, publicKey) {
+				report.BadSignatures = append(report.BadSignatures, version)
+			}
+		}
+		previous = hashLogRecord(data)
+		previousChained = chained
+		next = version + uint64(len(batch.Operations))
+		hashes[next-1] = previous
+	}
+	if report.Batches > 0 {
+		report.LastVersion = next - 1
+		report.Head = previous
+	}
+
+	snapshots, err := a.SnapshotVersions()
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range snapshots {
+		manifest, err := a.snapshotManifest(version)
+		if IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if manifest.ChainHead == nil || report.Batches == 0 || version < first || version > report.LastVersion {
+			// The log records before it may have been deleted,
+			// and the ones after it don't include it.
+			continue
+		}
+		if !bytes.Equal(hashes[version], manifest.ChainHead) {
+			report.SnapshotMismatches = append(report.SnapshotMismatches, version)
+		}
+	}
+	return report, nil
+}
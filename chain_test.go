@@ -0,0 +1,123 @@
+package rig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectStore := NewFileObjectStore(dir)
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := NewRiggedService(&testService{}, objectStore, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	rs.SetSigningKey(privateKey)
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		rs.Apply(Operation{Method: "set", Data: []byte("abc")}, false)
+		if _, err = rs.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := rs.Archive()
+	report, err := archive.VerifyChain(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Batches != 3 || report.LastVersion != 3 || !bytes.Equal(report.Head, rs.chainHead) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if manifest, err := archive.snapshotManifest(3); err != nil || !bytes.Equal(manifest.ChainHead, report.Head) || !manifest.Signed {
+		t.Fatalf("unexpected snapshot manifest %+v (%v)", manifest, err)
+	}
+
+	// Alter the second log record without signing it again.
+	batch, err := archive.readLogRecord(logRecordName("svc", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.Operations[0].Data = []byte("xyz")
+	buf, err := encodeLogBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = objectStore.PutObject(logRecordName("svc", 2), bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatal(err)
+	}
+	report, err = archive.VerifyChain(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Broken, []uint64{3}) || !reflect.DeepEqual(report.BadSignatures, []uint64{2}) {
+		t.Fatalf("expected record 3 to be broken and record 2 to have a bad signature, got %+v", report)
+	}
+
+	// Recover from the log instead of the snapshot.
+	if err = os.Remove(filepath.Join(dir, "svc", "LATEST")); err != nil {
+		t.Fatal(err)
+	}
+	recoverErr := func(key ed25519.PublicKey) error {
+		rs, err := NewRiggedService(&testService{}, objectStore, "svc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.testSleep = true
+		if key != nil {
+			rs.SetVerifyKey(key)
+		}
+		return rs.Recover()
+	}
+	if err = recoverErr(nil); err != (ChainError{Version: 3, Err: ErrChainBroken}) {
+		t.Fatalf("expected a broken chain at version 3, got %v", err)
+	}
+	if err = recoverErr(publicKey); err != (ChainError{Version: 2, Err: ErrInvalidSignature}) {
+		t.Fatalf("expected an invalid signature at version 2, got %v", err)
+	}
+
+	// Remove the signatures and chain the records again.
+	var previous []byte
+	for version := uint64(1); version <= 3; version++ {
+		batch, err := archive.readLogRecord(logRecordName("svc", version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch.Signature = nil
+		batch.Previous = previous
+		buf, err := encodeLogBatch(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous = hashLogRecord(buf.Bytes())
+		if err = objectStore.PutObject(logRecordName("svc", version), bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = recoverErr(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = recoverErr(publicKey); err != (ChainError{Version: 1, Err: ErrInvalidSignature}) {
+		t.Fatalf("expected a missing signature at version 1, got %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/Preetam/rig"
+)
+
+var errVerifyFailed = errors.New("verification failed")
+
+func runStatus(env *env, args []string, w io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	latest, err := env.archive.LatestSnapshotVersion()
+	if err != nil {
+		if !rig.IsNotExist(err) {
+			return err
+		}
+		fmt.Fprintln(w, "latest snapshot: none")
+	} else {
+		fmt.Fprintf(w, "latest snapshot: %016x\n", latest)
+	}
+	snapshots, err := env.archive.SnapshotVersions()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "snapshots: %d\n", len(snapshots))
+	records, err := env.archive.LogRecords()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "log records: %d\n", len(records))
+	if len(records) > 0 {
+		fmt.Fprintf(w, "newest log record: %016x\n", records[len(records)-1].Version)
+	}
+	return nil
+}
+
+func runListLogs(env *env, args []string, w io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	records, err := env.archive.LogRecords()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.Timestamp > 0 {
+			fmt.Fprintf(w, "%016x\t%d\t%s\n", record.Version, record.Timestamp, record.Name)
+		} else {
+			fmt.Fprintf(w, "%016x\t-\t%s\n", record.Version, record.Name)
+		}
+	}
+	return nil
+}
+
+func runListSnapshots(env *env, args []string, w io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	versions, err := env.archive.SnapshotVersions()
+	if err != nil {
+		return err
+	}
+	hasLatest := true
+	latest, err := env.archive.LatestSnapshotVersion()
+	if rig.IsNotExist(err) {
+		hasLatest = false
+	} else if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if hasLatest && version == latest {
+			fmt.Fprintf(w, "%016x\tLATEST\n", version)
+		} else {
+			fmt.Fprintf(w, "%016x\n", version)
+		}
+	}
+	return nil
+}
+
+type logEntry struct {
+	Version uint64 `json:"version"`
+	rig.Operation
+}
+
+func runCatLog(env *env, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	version, err := strconv.ParseUint(args[0], 16, 64)
+	if err != nil {
+		return errUsage
+	}
+	ops, err := env.archive.ReadLogBatch(version)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for i, op := range ops {
+		err = enc.Encode(logEntry{Version: version + uint64(i), Operation: op})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCatSnapshot(env *env, args []string, w io.Writer) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	var version uint64
+	var err error
+	if len(args) == 1 {
+		version, err = strconv.ParseUint(args[0], 16, 64)
+		if err != nil {
+			return errUsage
+		}
+	} else {
+		version, err = env.archive.LatestSnapshotVersion()
+		if err != nil {
+			return err
+		}
+	}
+	r, err := env.archive.OpenSnapshot(version)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func runVerify(env *env, args []string, w io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	report, err := env.archive.Verify()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "snapshot: %016x\n", report.SnapshotVersion)
+	fmt.Fprintf(w, "log records: %d\n", report.Batches)
+	fmt.Fprintf(w, "last version: %016x\n", report.LastVersion)
+	for _, gap := range report.Gaps {
+		fmt.Fprintf(w, "gap: %016x-%016x\n", gap.First, gap.Last)
+	}
+	for _, duplicate := range report.Duplicates {
+		fmt.Fprintf(w, "duplicate: %016x-%016x\n", duplicate.First, duplicate.Last)
+	}
+	for _, name := range report.Undecodable {
+		fmt.Fprintf(w, "undecodable: %s\n", name)
+	}
+	if !report.OK() {
+		return errVerifyFailed
+	}
+	fmt.Fprintln(w, "OK")
+	return nil
+}
+
+func runVerifySnapshot(env *env, args []string, w io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	var version uint64
+	var err error
+	if len(args) == 2 {
+		version, err = strconv.ParseUint(args[1], 16, 64)
+		if err != nil {
+			return errUsage
+		}
+	} else {
+		version, err = env.archive.LatestSnapshotVersion()
+		if err != nil {
+			return err
+		}
+	}
+	service, err := rig.NewService(args[0])
+	if err != nil {
+		return err
+	}
+	err = env.archive.VerifySnapshot(service, version)
+	if divergence, ok := err.(rig.ErrDivergence); ok {
+		fmt.Fprintf(w, "snapshot: %016x\n", version)
+		fmt.Fprintf(w, "expected digest: %x\n", divergence.Digest)
+		fmt.Fprintf(w, "restored digest: %x\n", divergence.LocalDigest)
+		return errVerifyFailed
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "snapshot: %016x\n", version)
+	fmt.Fprintln(w, "OK")
+	return nil
+}
+
+func runVerifyChain(env *env, args []string, w io.Writer) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	var publicKey ed25519.PublicKey
+	if len(args) == 1 {
+		key, err := hex.DecodeString(args[0])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errUsage
+		}
+		publicKey = key
+	}
+	report, err := env.archive.VerifyChain(publicKey)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "log records: %d\n", report.Batches)
+	fmt.Fprintf(w, "last version: %016x\n", report.LastVersion)
+	fmt.Fprintf(w, "head: %x\n", report.Head)
+	for _, version := range report.Broken {
+		fmt.Fprintf(w, "broken: %016x\n", version)
+	}
+	for _, version := range report.Unsigned {
+		fmt.Fprintf(w, "unsigned: %016x\n", version)
+	}
+	for _, version := range report.BadSignatures {
+		fmt.Fprintf(w, "bad signature: %016x\n", version)
+	}
+	for _, version := range report.SnapshotMismatches {
+		fmt.Fprintf(w, "snapshot mismatch: %016x\n", version)
+	}
+	for _, name := range report.Undecodable {
+		fmt.Fprintf(w, "undecodable: %s\n", name)
+	}
+	if !report.OK() {
+		return errVerifyFailed
+	}
+	fmt.Fprintln(w, "OK")
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Preetam/rig"
+	"github.com/Preetam/rig/kvservice"
+)
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rigctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectStore := rig.NewFileObjectStore(dir)
+
+	// kv has a snapshot at version 2 and log records through version 3.
+	rs, err := rig.NewRiggedService(kvservice.New(), objectStore, "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rs.ApplyBatch(context.Background(), []rig.Operation{
+		kvservice.Set("a", []byte("1")),
+		kvservice.Set("b", []byte("2")),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.Apply(kvservice.Set("c", []byte("3")), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// empty has a snapshot at version 0 and no LATEST.
+	rs, err = rig.NewRiggedService(kvservice.New(), objectStore, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(dir, "empty", "LATEST")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		args   []string
+		// want are strings the output must contain.
+		want []string
+		err  error
+	}{
+		{"kv", []string{"status"}, []string{"latest snapshot: 0000000000000002\n", "snapshots: 1\n", "newest log record: 0000000000000003\n"}, nil},
+		{"kv", []string{"status", "x"}, nil, errUsage},
+		{"empty", []string{"status"}, []string{"latest snapshot: none\n", "log records: 0\n"}, nil},
+		{"kv", []string{"ls-logs"}, []string{"0000000000000001\t-\t", "0000000000000003\t-\t"}, nil},
+		{"kv", []string{"ls-snapshots"}, []string{"0000000000000002\tLATEST\n"}, nil},
+		{"empty", []string{"ls-snapshots"}, []string{"0000000000000000\n"}, nil},
+		{"kv", []string{"cat-log", "3"}, []string{`"version":3,"method":"set"`}, nil},
+		{"kv", []string{"cat-log", "x"}, nil, errUsage},
+		{"kv", []string{"cat-snapshot"}, nil, nil},
+		{"kv", []string{"cat-snapshot", "2"}, nil, nil},
+		{"empty", []string{"cat-snapshot"}, nil, errNotFound},
+		{"kv", []string{"verify"}, []string{"snapshot: 0000000000000002\n", "last version: 0000000000000003\n", "OK\n"}, nil},
+		{"kv", []string{"verify-snapshot", "kv"}, []string{"snapshot: 0000000000000002\n", "OK\n"}, nil},
+		{"kv", []string{"verify-snapshot"}, nil, errUsage},
+		{"kv", []string{"verify-chain"}, []string{"log records: 2\n", "OK\n"}, nil},
+		{"kv", []string{"verify-chain", "abc"}, nil, errUsage},
+		{"kv", []string{"replay", "-service", "kv", "-dest-prefix", "copy", "-q"}, []string{"replayed through 0000000000000003\n"}, nil},
+		{"kv", []string{"replay", "-service", "kv", "-dest-prefix", "kv", "-q"}, nil, errSameDestination},
+	}
+	for _, test := range tests {
+		e := &env{
+			objectStore: objectStore,
+			prefix:      test.prefix,
+			archive:     rig.NewArchive(objectStore, test.prefix),
+		}
+		w := &bytes.Buffer{}
+		err := commands[test.args[0]].run(e, test.args[1:], w)
+		if rig.IsNotExist(err) {
+			err = errNotFound
+		}
+		if err != test.err {
+			t.Errorf("%s %v: expected error %v, got %v", test.prefix, test.args, test.err, err)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(w.String(), want) {
+				t.Errorf("%s %v: expected output to contain %q, got %q", test.prefix, test.args, want, w.String())
+			}
+		}
+		if test.args[0] == "ls-snapshots" && test.prefix == "empty" && strings.Contains(w.String(), "LATEST") {
+			t.Errorf("expected no LATEST snapshot without a LATEST object, got %q", w.String())
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Command rigctl inspects the objects written by the rig
+// to a file object store directory or an S3 bucket.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/Preetam/rig"
+	// Services available to replay.
+	_ "github.com/Preetam/rig/kvservice"
+)
+
+type command struct {
+	args  string
+	usage string
+	run   func(env *env, args []string, w io.Writer) error
+}
+
+// env is the store that commands operate on.
+type env struct {
+	objectStore rig.ObjectStore
+	prefix      string
+	archive     *rig.Archive
+
+	// region and endpoint are used to open other S3 stores.
+	region   string
+	endpoint string
+}
+
+var commands = map[string]command{
+	"status":          {"", "show the latest snapshot and log", runStatus},
+	"ls-logs":         {"", "list log records", runListLogs},
+	"ls-snapshots":    {"", "list snapshots", runListSnapshots},
+	"cat-log":         {"<version>", "print the operations in a log record", runCatLog},
+	"cat-snapshot":    {"[version]", "write a snapshot (default latest) to stdout", runCatSnapshot},
+	"verify":          {"", "check version continuity from the latest snapshot", runVerify},
+	"verify-snapshot": {"<service> [version]", "check a snapshot (default latest) against its digest", runVerifySnapshot},
+	"verify-chain":    {"[public key]", "check the hash chain and hex public key signatures of the log", runVerifyChain},
+	"replay":          {"[replay flags]", "rebuild state into another store or prefix", runReplay},
+}
+
+var (
+	errUsage    = errors.New("invalid arguments")
+	errNotFound = errors.New("object does not exist")
+)
+
+func main() {
+	dir := flag.String("dir", "", "file object store directory")
+	bucket := flag.String("bucket", "", "S3 bucket")
+	endpoint := flag.String("endpoint", "", "S3 endpoint URL, for S3-compatible stores")
+	region := flag.String("region", defaultRegion(), "S3 region")
+	prefix := flag.String("prefix", "", "rig prefix within the store")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rigctl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	objectStore, err := openObjectStore(*dir, *bucket, *region, *endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rigctl:", err)
+		os.Exit(2)
+	}
+	e := &env{
+		objectStore: objectStore,
+		prefix:      *prefix,
+		archive:     rig.NewArchive(objectStore, *prefix),
+		region:      *region,
+		endpoint:    *endpoint,
+	}
+
+	err = cmd.run(e, flag.Args()[1:], os.Stdout)
+	if err != nil {
+		if rig.IsNotExist(err) {
+			err = errNotFound
+		}
+		fmt.Fprintln(os.Stderr, "rigctl:", err)
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: rigctl [flags] %s %s\n", flag.Arg(0), cmd.args)
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+func openObjectStore(dir, bucket, region, endpoint string) (rig.ObjectStore, error) {
+	switch {
+	case dir != "" && bucket == "":
+		return rig.NewFileObjectStore(dir), nil
+	case bucket != "" && dir == "":
+		return rig.NewS3ObjectStore(newS3(region, endpoint), bucket), nil
+	}
+	return nil, errors.New("exactly one of -dir or -bucket is required")
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: rigctl [flags] <command> [args]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-36s %s\n", name+" "+cmd.args, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Preetam/rig"
+)
+
+var errSameDestination = errors.New("destination is the same as the source")
+
+// runReplay replays into a registered service. Services are linked into
+// rigctl by importing their packages for side effects, like database/sql
+// drivers, and register themselves with rig.RegisterService.
+func runReplay(env *env, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	serviceName := flags.String("service", "", "registered service to replay into ("+strings.Join(rig.Services(), ", ")+")")
+	destDir := flags.String("dest-dir", "", "destination file object store directory")
+	destBucket := flags.String("dest-bucket", "", "destination S3 bucket")
+	destEndpoint := flags.String("dest-endpoint", env.endpoint, "destination S3 endpoint URL")
+	destPrefix := flags.String("dest-prefix", "", "destination rig prefix")
+	fromSnapshot := flags.Bool("from-snapshot", false, "start from the latest source snapshot instead of the first log record")
+	rewriteLogs := flags.Bool("rewrite-logs", false, "write re-encoded log records to the destination")
+	checkpoint := flags.Uint64("checkpoint", 100000, "operations between destination snapshots, 0 to snapshot only at the end")
+	quiet := flags.Bool("q", false, "don't report progress")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *serviceName == "" {
+		fmt.Fprintln(os.Stderr, "replay flags:")
+		flags.SetOutput(os.Stderr)
+		flags.PrintDefaults()
+		return errUsage
+	}
+
+	destination := env.objectStore
+	if *destDir != "" || *destBucket != "" {
+		var err error
+		destination, err = openObjectStore(*destDir, *destBucket, env.region, *destEndpoint)
+		if err != nil {
+			return err
+		}
+	} else if *destPrefix == env.prefix {
+		return errSameDestination
+	}
+
+	service, err := rig.NewService(*serviceName)
+	if err != nil {
+		return err
+	}
+	config := rig.ReplayConfig{
+		Source:             env.objectStore,
+		SourcePrefix:       env.prefix,
+		Destination:        destination,
+		DestinationPrefix:  *destPrefix,
+		Service:            service,
+		FromSnapshot:       *fromSnapshot,
+		RewriteLogs:        *rewriteLogs,
+		CheckpointInterval: *checkpoint,
+	}
+	if !*quiet {
+		config.Progress = func(p rig.ReplayProgress) {
+			fmt.Fprintf(os.Stderr, "replayed %016x of %016x (checkpoint %016x)\n", p.Version, p.LastVersion, p.Checkpoint)
+		}
+	}
+	version, err := rig.Replay(config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "replayed through %016x\n", version)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// configProvider is a minimal client.ConfigProvider with the handlers
+// needed to send S3 requests. Requests are not retried.
+type configProvider struct {
+	region   string
+	endpoint string
+}
+
+func newS3(region, endpoint string) *s3.S3 {
+	config := aws.NewConfig().
+		WithRegion(region).
+		WithHTTPClient(http.DefaultClient).
+		WithCredentials(credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvProvider{},
+			&credentials.SharedCredentialsProvider{},
+		}))
+	if endpoint != "" {
+		// S3 stand-ins usually don't support virtual-hosted buckets.
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	return s3.New(configProvider{region: region, endpoint: endpoint}, config)
+}
+
+func (p configProvider) ClientConfig(serviceName string, cfgs ...*aws.Config) client.Config {
+	config := aws.NewConfig()
+	config.MergeIn(cfgs...)
+	endpoint := p.endpoint
+	if endpoint == "" {
+		resolved, err := endpoints.DefaultResolver().EndpointFor(serviceName, p.region)
+		if err == nil {
+			endpoint = resolved.URL
+		}
+	}
+
+	handlers := request.Handlers{}
+	handlers.Build.PushBack(buildContentLength)
+	handlers.Send.PushBack(send)
+	handlers.ValidateResponse.PushBack(validateResponse)
+	return client.Config{
+		Config:        config,
+		Handlers:      handlers,
+		Endpoint:      endpoint,
+		SigningRegion: p.region,
+		SigningName:   serviceName,
+	}
+}
+
+func buildContentLength(r *request.Request) {
+	var length int64
+	if lengthStr := r.HTTPRequest.Header.Get("Content-Length"); lengthStr != "" {
+		length, _ = strconv.ParseInt(lengthStr, 10, 64)
+	} else if r.Body != nil {
+		var err error
+		length, err = aws.SeekerLen(r.Body)
+		if err != nil {
+			r.Error = awserr.New(request.ErrCodeSerialization, "failed to get request body's length", err)
+			return
+		}
+	}
+	if length > 0 {
+		r.HTTPRequest.ContentLength = length
+		r.HTTPRequest.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	} else {
+		r.HTTPRequest.ContentLength = 0
+		r.HTTPRequest.Header.Del("Content-Length")
+	}
+}
+
+func send(r *request.Request) {
+	resp, err := r.Config.HTTPClient.Do(r.HTTPRequest)
+	if err != nil {
+		r.Error = awserr.New("RequestError", "send request failed", err)
+		return
+	}
+	r.HTTPResponse = resp
+}
+
+func validateResponse(r *request.Request) {
+	if r.HTTPResponse.StatusCode == 0 || r.HTTPResponse.StatusCode >= 300 {
+		// The S3 error unmarshaler replaces this
+		// with the error from the response body.
+		r.Error = awserr.New("UnknownError", "unknown error", nil)
+	}
+}
+
+func defaultRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
@@ -0,0 +1,174 @@
+package rig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrNoDigest is returned by Archive.VerifySnapshot when the snapshot
+// wasn't written with a digest or the service isn't a Digester.
+var ErrNoDigest = errors.New("rig: no digest to compare")
+
+// Digester is a Service that can hash its state. The digests of
+// services with the same state at the same version must be equal.
+// The rig records the leader's digests in snapshot manifests and in
+// log records, at most every SetDigestInterval versions, and compares
+// them with the digest of the state it has after recovering or
+// following the log.
+//
+// Digest is called while operations can't be applied, so it should
+// take about as long as applying an operation, not as long as
+// serializing the state. Keep the hash up to date as operations are
+// applied, like with a Merkle tree, instead of computing it from the
+// whole state.
+type Digester interface {
+	// Digest returns a hash of the state at the current version.
+	Digest() ([]byte, error)
+}
+
+// DefaultDigestInterval is how many versions apart the digests
+// recorded in log records are by default.
+const DefaultDigestInterval = 1000
+
+// SetDigestInterval sets how many versions apart the digests recorded
+// in log records are at least. A log record only has one if the service
+// is at the record's last version when it's flushed, so they can be
+// further apart. 1 records one in every log record where possible,
+// and 0 only records digests in snapshot manifests.
+func (rs *RiggedService) SetDigestInterval(versions uint64) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.digestInterval = versions
+}
+
+// ErrDivergence is returned when the state of a service doesn't match
+// the digest recorded by the leader. The service must be restored
+// from a snapshot that matches, or the leader's history investigated.
+type ErrDivergence struct {
+	// Version and Digest were recorded by the leader.
+	Version uint64
+	Digest  []byte
+	// LocalVersion and LocalDigest are from the local service.
+	LocalVersion uint64
+	LocalDigest  []byte
+}
+
+func (e ErrDivergence) Error() string {
+	return fmt.Sprintf("rig: state diverged: digest %x at version %d, expected %x at version %d",
+		e.LocalDigest, e.LocalVersion, e.Digest, e.Version)
+}
+
+// snapshotManifest is stored next to a snapshot.
+type snapshotManifest struct {
+	Version uint64 `json:"version"`
+	Digest  []byte `json:"digest,omitempty"`
+	// ChainHead is the hash of the log record ending at the snapshot's
+	// version, and Signed is true if the log records are signed.
+	ChainHead []byte `json:"chain_head,omitempty"`
+	Signed    bool   `json:"signed,omitempty"`
+}
+
+// digest returns the digest of a service, or
+// nil if the service isn't a Digester.
+func digest(service Service) ([]byte, error) {
+	digester, ok := service.(Digester)
+	if !ok {
+		return nil, nil
+	}
+	return digester.Digest()
+}
+
+// checkDigest compares the digest of a service with the digest
+// recorded at a version, if the service is a Digester.
+func checkDigest(service Service, version uint64, expected []byte) error {
+	local, err := digest(service)
+	if err != nil || local == nil {
+		return err
+	}
+	if bytes.Equal(local, expected) {
+		return nil
+	}
+	localVersion, err := service.Version()
+	if err != nil {
+		return err
+	}
+	return ErrDivergence{
+		Version:      version,
+		Digest:       expected,
+		LocalVersion: localVersion,
+		LocalDigest:  local,
+	}
+}
+
+// checkDigest compares the digest of the service with a digest recorded
+// at a version, if there is one and the service is at that version.
+// The caller must hold rs.lock.
+func (rs *RiggedService) checkDigest(version uint64, expected []byte) error {
+	if expected == nil || version != rs.currentVersion {
+		return nil
+	}
+	return checkDigest(rs.service, version, expected)
+}
+
+// checkSnapshot compares the digest of the service with the one in the
+// manifest of the snapshot it restored, and continues the log's chain
+// from it. The caller must hold rs.lock.
+func (rs *RiggedService) checkSnapshot(archive *Archive, version uint64) error {
+	manifest, err := archive.snapshotManifest(version)
+	if err == errDoesNotExist {
+		// Written before manifests were.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rs.chainHead = manifest.ChainHead
+	rs.chainSigned = manifest.Signed
+	return rs.checkDigest(version, manifest.Digest)
+}
+
+// SnapshotDigest returns the digest recorded for the snapshot at a
+// version, or nil if the service didn't have one.
+func (a *Archive) SnapshotDigest(version uint64) ([]byte, error) {
+	manifest, err := a.snapshotManifest(version)
+	return manifest.Digest, err
+}
+
+func (a *Archive) snapshotManifest(version uint64) (snapshotManifest, error) {
+	manifest := snapshotManifest{}
+	r, err := a.objectStore.GetObject(snapshotManifestName(a.prefix, version))
+	if err != nil {
+		return manifest, err
+	}
+	defer r.Close()
+	err = json.NewDecoder(r).Decode(&manifest)
+	return manifest, err
+}
+
+// VerifySnapshot restores the snapshot at a version into service,
+// which should be empty, and compares its digest with the one recorded
+// for the snapshot. It returns ErrDivergence if they differ.
+func (a *Archive) VerifySnapshot(service Service, version uint64) error {
+	if _, ok := service.(Digester); !ok {
+		return ErrNoDigest
+	}
+	expected, err := a.SnapshotDigest(version)
+	if err != nil && err != errDoesNotExist {
+		return err
+	}
+	if expected == nil {
+		return ErrNoDigest
+	}
+	r, err := a.OpenSnapshot(version)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	err = service.Restore(version, r)
+	if err != nil {
+		return err
+	}
+	return checkDigest(service, version, expected)
+}
@@ -0,0 +1,116 @@
+package rig
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// digestService has a digest of its version and salt, so services
+// with different salts diverge.
+type digestService struct {
+	testService
+	salt string
+}
+
+func (s *digestService) Digest() ([]byte, error) {
+	return []byte(fmt.Sprint(s.version, s.salt)), nil
+}
+
+func TestDigests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectStore := NewFileObjectStore(dir)
+
+	rs, err := NewRiggedService(&digestService{}, objectStore, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	rs.SetDigestInterval(2)
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	op := Operation{Method: "set", Data: []byte("abc")}
+	for i := 0; i < 3; i++ {
+		rs.Apply(op, false)
+	}
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(op, false)
+	rs.Apply(op, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := rs.Archive()
+	batch, err := archive.readLogRecord(logRecordName("svc", 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(batch.Digest) != "5" {
+		t.Fatalf("expected the digest at version 5 in the log record, got %q", batch.Digest)
+	}
+	// The next log record is within the interval of the last digest.
+	rs.Apply(op, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	batch, err = archive.readLogRecord(logRecordName("svc", 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Digest != nil {
+		t.Fatalf("expected no digest at version 6, got %q", batch.Digest)
+	}
+	if err = archive.VerifySnapshot(&digestService{}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err = archive.VerifySnapshot(&testService{}, 3); err != ErrNoDigest {
+		t.Fatalf("expected ErrNoDigest for a service without digests, got %v", err)
+	}
+	err = archive.VerifySnapshot(&digestService{salt: "x"}, 3)
+	if divergence, ok := err.(ErrDivergence); !ok || divergence.Version != 3 || divergence.LocalVersion != 3 ||
+		string(divergence.Digest) != "3" || string(divergence.LocalDigest) != "3x" {
+		t.Fatalf("expected ErrDivergence at version 3, got %v", err)
+	}
+
+	rs, err = NewRiggedService(&digestService{}, objectStore, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	rs, err = NewRiggedService(&digestService{salt: "x"}, objectStore, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if _, ok := rs.Recover().(ErrDivergence); !ok {
+		t.Fatal("expected Recover to return ErrDivergence")
+	}
+}
+
+func TestDecodeLegacyLogBatch(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(`[{"method":"set","data":"YWJj"}]` + "\n"))
+	w.Close()
+	batch, err := decodeLogBatch(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Operations) != 1 || batch.Operations[0].Method != "set" ||
+		string(batch.Operations[0].Data) != "abc" || batch.Digest != nil {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+}
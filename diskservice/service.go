@@ -0,0 +1,132 @@
+// Package diskservice adapts a bptree database file to rig.Service,
+// for state that doesn't fit in memory.
+//
+// Each operation is applied in a database transaction that also records
+// its version, so the state on disk always matches Version. After a
+// restart, the rig only replays the log after that version instead of
+// restoring the latest snapshot.
+//
+// The database file is compacted after an operation once more than half
+// of it is left over from older versions, so that it stays proportional
+// to the state.
+package diskservice
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Preetam/rig"
+	"github.com/Preetam/rig/bptree"
+)
+
+// ApplyFunc applies an operation in a read-write transaction.
+// If it returns an error, the transaction is discarded.
+type ApplyFunc func(tx *bptree.Tx, op rig.Operation) error
+
+// ValidateFunc validates an operation in a read-only transaction
+// with the current state.
+type ValidateFunc func(tx *bptree.Tx, op rig.Operation) error
+
+// compactMinGarbage is the least garbage in the database file, in bytes,
+// that is worth compacting, so that small files aren't rewritten often.
+const compactMinGarbage = 4 << 20
+
+// Service is a rig.Service that stores its state in a bptree database.
+type Service struct {
+	db         *bptree.DB
+	apply      ApplyFunc
+	validate   ValidateFunc
+	minGarbage int64
+}
+
+var _ rig.Service = &Service{}
+
+// Open opens or creates the database file at path. validate may be nil.
+func Open(path string, apply ApplyFunc, validate ValidateFunc) (*Service, error) {
+	db, err := bptree.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		db:         db,
+		apply:      apply,
+		validate:   validate,
+		minGarbage: compactMinGarbage,
+	}, nil
+}
+
+// DB returns the database, for reading with View.
+func (s *Service) DB() *bptree.DB {
+	return s.db
+}
+
+// Close closes the database.
+func (s *Service) Close() error {
+	return s.db.Close()
+}
+
+func (s *Service) Version() (uint64, error) {
+	return s.db.Version()
+}
+
+func (s *Service) Validate(op rig.Operation) error {
+	if s.validate == nil {
+		return nil
+	}
+	return s.db.View(func(tx *bptree.Tx) error {
+		return s.validate(tx, op)
+	})
+}
+
+func (s *Service) Apply(version uint64, op rig.Operation) error {
+	err := s.db.Update(func(tx *bptree.Tx) error {
+		err := s.apply(tx, op)
+		if err != nil {
+			return err
+		}
+		return tx.SetVersion(version)
+	})
+	if err != nil {
+		return err
+	}
+	s.compact()
+	return nil
+}
+
+// compact compacts the database file if enough of it is garbage.
+// The operation has already been committed, and a failed compaction
+// leaves the file as it was, so errors are ignored and compaction is
+// tried again after the next operation.
+func (s *Service) compact() {
+	live, garbage, err := s.db.Usage()
+	if err != nil || garbage <= live || garbage < s.minGarbage {
+		return
+	}
+	s.db.Compact()
+}
+
+// Snapshot returns a compacted copy of the database file.
+// Operations can be applied while it is uploaded.
+func (s *Service) Snapshot() (io.ReadSeeker, int64, error) {
+	snapshot, err := s.db.Snapshot()
+	if err != nil {
+		return nil, 0, err
+	}
+	return snapshot, snapshot.Size(), nil
+}
+
+// Restore replaces the database file with a snapshot.
+func (s *Service) Restore(version uint64, r io.Reader) error {
+	err := s.db.Restore(r)
+	if err != nil {
+		return err
+	}
+	restoredVersion, err := s.db.Version()
+	if err != nil {
+		return err
+	}
+	if restoredVersion != version {
+		return fmt.Errorf("diskservice: snapshot has version %d, expected %d", restoredVersion, version)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package diskservice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Preetam/rig"
+	"github.com/Preetam/rig/bptree"
+)
+
+var errNoValue = errors.New("no value")
+
+// setKey sets a key to a value from "key=value".
+func setKey(tx *bptree.Tx, op rig.Operation) error {
+	parts := bytes.SplitN(op.Data, []byte("="), 2)
+	if err := tx.Put(parts[0], nil); err != nil {
+		return err
+	}
+	if len(parts) < 2 {
+		// The key that was put is discarded with the transaction.
+		return errNoValue
+	}
+	return tx.Put(parts[0], parts[1])
+}
+
+func keys(t *testing.T, s *Service) []string {
+	t.Helper()
+	result := []string{}
+	err := s.DB().View(func(tx *bptree.Tx) error {
+		return tx.Ascend(nil, nil, func(key, value []byte) bool {
+			result = append(result, string(key))
+			return true
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+	errExists := errors.New("key exists")
+	validate := func(tx *bptree.Tx, op rig.Operation) error {
+		key := bytes.SplitN(op.Data, []byte("="), 2)[0]
+		value, err := tx.Get(key)
+		if err == nil && value != nil {
+			err = errExists
+		}
+		return err
+	}
+
+	s, err := Open(path, setKey, validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"b", "a", "c"} {
+		op := rig.Operation{Method: "set", Data: []byte(key + "=" + key)}
+		if err = s.Validate(op); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Apply(uint64(i+1), op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Validate(rig.Operation{Method: "set", Data: []byte("a=x")}); err != errExists {
+		t.Fatalf("expected the validate function's error, got %v", err)
+	}
+	snapshot, size, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotData, err := ioutil.ReadAll(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(snapshotData)) != size {
+		t.Fatalf("expected a %d byte snapshot, got %d bytes", size, len(snapshotData))
+	}
+	snapshot.(*bptree.Snapshot).Close()
+
+	// A failed operation doesn't change the state or the version.
+	if err = s.Apply(4, rig.Operation{Method: "set", Data: []byte("e")}); err != errNoValue {
+		t.Fatalf("expected the apply function's error, got %v", err)
+	}
+	if err = s.Apply(4, rig.Operation{Method: "set", Data: []byte("d=d")}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// The state and its version are kept when the file is opened again.
+	s, err = Open(path, setKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if version, _ := s.Version(); version != 4 {
+		t.Fatalf("expected version 4, got %d", version)
+	}
+	if got := fmt.Sprint(keys(t, s)); got != "[a b c d]" {
+		t.Fatalf("expected keys [a b c d], got %s", got)
+	}
+
+	if err = s.Restore(2, bytes.NewReader(snapshotData)); err == nil {
+		t.Fatal("expected an error restoring a snapshot with a different version")
+	}
+	if err = s.Restore(3, bytes.NewReader(snapshotData)); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := s.Version(); version != 3 {
+		t.Fatalf("expected version 3, got %d", version)
+	}
+	if got := fmt.Sprint(keys(t, s)); got != "[a b c]" {
+		t.Fatalf("expected keys [a b c], got %s", got)
+	}
+}
+
+func TestServiceCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+	s, err := Open(path, setKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.minGarbage = 64 << 10
+
+	value := string(bytes.Repeat([]byte("x"), 100))
+	maxSize := int64(0)
+	for version := uint64(1); version <= 2000; version++ {
+		op := rig.Operation{Method: "set", Data: []byte(fmt.Sprint("key", version%100, "=", value))}
+		if err = s.Apply(version, op); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxSize {
+			maxSize = info.Size()
+		}
+	}
+	live, _, err := s.DB().Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file is compacted when the garbage passes the minimum
+	// or the live size, plus at most one more operation.
+	if limit := 2*live + s.minGarbage + 64<<10; maxSize > limit {
+		t.Fatalf("expected the file to stay under %d bytes, got %d", limit, maxSize)
+	}
+	if version, _ := s.Version(); version != 2000 {
+		t.Fatalf("expected version 2000, got %d", version)
+	}
+	if got := len(keys(t, s)); got != 100 {
+		t.Fatalf("expected 100 keys, got %d", got)
+	}
+}
@@ -0,0 +1,7 @@
+package rig
+
+// DisableRecoverSleep avoids the consistency sleep in Recover
+// for tests in other packages.
+func DisableRecoverSleep(rs *RiggedService) {
+	rs.testSleep = true
+}
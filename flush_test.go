@@ -0,0 +1,118 @@
+package rig
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readLogMethods returns the methods of the operations in a log record.
+func readLogMethods(t *testing.T, dir string, version uint64) string {
+	t.Helper()
+	ops, err := NewArchive(NewFileObjectStore(dir), "svc").ReadLogBatch(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := []string{}
+	for _, op := range ops {
+		methods = append(methods, op.Method)
+	}
+	return strings.Join(methods, ",")
+}
+
+func TestFlushFailures(t *testing.T) {
+	errFailed := errors.New("failed")
+	failLog := func(name string) error {
+		if strings.HasSuffix(name, "/LOG/0000000000000001") {
+			return errFailed
+		}
+		return nil
+	}
+	failDuplicate := func(name string) error {
+		if strings.Contains(name, "/LOG/0000000000000001-") {
+			return errFailed
+		}
+		return nil
+	}
+
+	for _, test := range []struct {
+		name string
+		fail func(name string) error
+		// writeOnFailure is true if the failed write reaches
+		// the store, like a timeout after the upload.
+		writeOnFailure bool
+		logPuts        int
+	}{
+		{name: "log record", fail: failLog, logPuts: 1},
+		{name: "log record after upload", fail: failLog, writeOnFailure: true, logPuts: 2},
+		{name: "duplicate", fail: failDuplicate, logPuts: 1},
+		{name: "duplicate after upload", fail: failDuplicate, writeOnFailure: true, logPuts: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rig")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			rs, store := newFaultyRiggedService(t, dir)
+			rs.Apply(Operation{Method: "a"}, false)
+			rs.Apply(Operation{Method: "b"}, false)
+			store.setFail(func(name string) error {
+				err := test.fail(name)
+				if err != nil && test.writeOnFailure {
+					store.lock.Lock()
+					store.puts[name]++
+					store.lock.Unlock()
+					store.ObjectStore.PutObject(name, strings.NewReader(""), 0)
+				}
+				return err
+			})
+			if _, err = rs.Flush(); err != errFailed {
+				t.Fatalf("expected the flush to fail, got %v", err)
+			}
+			if status := rs.Status(); status.LastFlush != 0 || status.Pending != 2 {
+				t.Fatalf("expected the batch to stay pending, got %+v", status)
+			}
+
+			// Operations applied after the failure
+			// aren't added to the failed batch.
+			rs.Apply(Operation{Method: "c"}, false)
+			store.setFail(nil)
+			if n, err := rs.Flush(); n != 3 || err != nil {
+				t.Fatalf("expected 3 flushed operations, got %d, %v", n, err)
+			}
+			if got := readLogMethods(t, dir, 1); got != "a,b" {
+				t.Fatalf("expected the retried batch to be identical, got %s", got)
+			}
+			if got := readLogMethods(t, dir, 3); got != "c" {
+				t.Fatalf("unexpected next batch %s", got)
+			}
+			logName := logRecordName("svc", 1)
+			if store.puts[logName] != test.logPuts {
+				t.Fatalf("expected %d writes of %s, got %d", test.logPuts, logName, store.puts[logName])
+			}
+			duplicates := 0
+			for name := range store.puts {
+				if strings.HasPrefix(name, logName+"-") {
+					duplicates++
+				}
+			}
+			if duplicates == 0 {
+				t.Fatal("expected a timestamped duplicate of the first log record")
+			}
+			for name := range store.puts {
+				if strings.HasPrefix(name, logRecordName("svc", 3)+"-") {
+					t.Fatalf("unexpected duplicate %s", name)
+				}
+			}
+
+			recovered, _ := newFaultyRiggedService(t, dir)
+			if version := recovered.Status().CurrentVersion; version != 3 {
+				t.Fatalf("expected to recover version 3, got %d", version)
+			}
+		})
+	}
+}
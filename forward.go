@@ -0,0 +1,141 @@
+package rig
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrLeaderUnavailable is returned when a follower can't forward
+	// operations because there's no leader or it can't be reached.
+	// The operations weren't applied, so they can be retried.
+	ErrLeaderUnavailable = errors.New("rig: leader unavailable")
+	// ErrOutcomeUnknown is returned when a follower sent operations to
+	// the leader but didn't get its response, so they may have been
+	// applied. Retrying them is only safe with the same idempotency key.
+	ErrOutcomeUnknown = errors.New("rig: forwarded operations may have been applied")
+)
+
+// defaultForwardTimeout is the timeout for forwarding operations
+// if ForwardConfig doesn't set one.
+const defaultForwardTimeout = 30 * time.Second
+
+// Forwarder sends operations to the leader at an address, which
+// applies them and returns the version assigned to the last one, or
+// the last one that was applied along with the error, like ApplyBatch.
+// Implementations return ErrLeaderUnavailable if the leader can't be
+// reached or isn't the leader anymore, ErrOutcomeUnknown if the
+// operations were sent but the leader's response wasn't received, and
+// the leader's errors, like ValidationError and ErrBackpressure,
+// otherwise. They send the idempotency key of the context, if it has
+// one, so that the leader applies retries at most once.
+type Forwarder interface {
+	Forward(ctx context.Context, leader string, ops []Operation, waitUntilDurable bool) (uint64, error)
+}
+
+// ForwardConfig configures how a follower forwards operations.
+type ForwardConfig struct {
+	Forwarder Forwarder
+	// Leader is the address of the leader. If it's empty, the
+	// address stored in the lease by the leader's Node is used.
+	Leader string
+	// WaitForApply makes ApplyBatch wait until the follower has
+	// applied the forwarded operations, so reads from the follower
+	// see them.
+	WaitForApply bool
+	// Timeout limits forwarding operations and waiting until the
+	// follower has applied them. The default is 30 seconds.
+	Timeout time.Duration
+}
+
+type noForwardKey struct{}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a context that makes a follower forward
+// operations with an idempotency key, so that the leader applies them
+// at most once if they are retried with the same key.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// IdempotencyKey returns the idempotency key of a context,
+// or "" if it doesn't have one.
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// WithoutForwarding returns a context that makes ApplyBatch return
+// ErrNotLeader on a follower instead of forwarding operations. Use it
+// for operations that were already forwarded, to avoid loops.
+func WithoutForwarding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noForwardKey{}, true)
+}
+
+// SetForwarding makes ApplyBatch forward operations to the leader
+// when the service is a follower.
+func (rs *RiggedService) SetForwarding(config ForwardConfig) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.forwarding = config
+}
+
+// forward forwards operations to the leader if the service is a
+// follower with a Forwarder. It returns false if it didn't.
+func (rs *RiggedService) forward(ctx context.Context, ops []Operation, waitUntilDurable bool) (uint64, bool, error) {
+	rs.lock.Lock()
+	config := rs.forwarding
+	role := rs.role
+	rs.lock.Unlock()
+	if role == Leader || config.Forwarder == nil || ctx.Value(noForwardKey{}) != nil {
+		return 0, false, nil
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultForwardTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	leader := config.Leader
+	if leader == "" {
+		current, err := readLease(rs.objectStore, rs.prefix)
+		if err != nil && err != errDoesNotExist {
+			return 0, true, err
+		}
+		if err == errDoesNotExist || current.Address == "" || time.Now().After(time.Unix(0, current.Expires)) {
+			return 0, true, ErrLeaderUnavailable
+		}
+		leader = current.Address
+	}
+	version, err := config.Forwarder.Forward(ctx, leader, ops, waitUntilDurable)
+	if err != nil {
+		// The version of the operations that were applied, if any.
+		return version, true, err
+	}
+	if config.WaitForApply {
+		err = rs.waitForVersion(ctx, version)
+	}
+	return version, true, err
+}
+
+// waitForVersion waits until the service has applied a version or the
+// context is done, which is at most the forwarding timeout.
+func (rs *RiggedService) waitForVersion(ctx context.Context, version uint64) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		rs.lock.Lock()
+		current := rs.currentVersion
+		rs.lock.Unlock()
+		if current >= version {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
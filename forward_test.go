@@ -0,0 +1,100 @@
+package rig
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testForwarder applies forwarded operations to leaders by address.
+type testForwarder struct {
+	leaders map[string]*RiggedService
+}
+
+func (f *testForwarder) Forward(ctx context.Context, leader string, ops []Operation, waitUntilDurable bool) (uint64, error) {
+	rs, ok := f.leaders[leader]
+	if !ok {
+		return 0, ErrLeaderUnavailable
+	}
+	return rs.ApplyBatch(WithoutForwarding(ctx), ops, waitUntilDurable)
+}
+
+func TestForwarding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newService := func() *RiggedService {
+		rs, err := NewRiggedService(&testService{}, NewFileObjectStore(dir), "svc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.testSleep = true
+		return rs
+	}
+	op := Operation{Method: "set", Data: []byte("abc")}
+
+	leader := newService()
+	follower := newService()
+	forwarder := &testForwarder{leaders: map[string]*RiggedService{"a": leader}}
+	NewNode(follower, NodeConfig{ID: "b"})
+	follower.SetForwarding(ForwardConfig{Forwarder: forwarder, WaitForApply: true})
+	if _, err = follower.ApplyBatch(context.Background(), []Operation{op}, false); err != ErrLeaderUnavailable {
+		t.Fatalf("expected ErrLeaderUnavailable without a lease, got %v", err)
+	}
+
+	node := NewNode(leader, NodeConfig{
+		ID:            "a",
+		Address:       "a",
+		LeaseDuration: time.Second,
+		ClockSkew:     time.Millisecond,
+		PollInterval:  10 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go node.Run(ctx)
+	waitFor(t, "a to become the leader", func() bool {
+		role, _ := node.Role()
+		return role == Leader
+	})
+	server, addr := startReplication(t, leader, 0)
+	defer server.Close()
+	client := NewReplicaClient(follower, addr)
+	go client.Run(ctx)
+
+	// The follower waits until it has applied
+	// the version the leader assigned.
+	version, err := follower.ApplyBatch(context.Background(), []Operation{op, op}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected version 2, got %d", version)
+	}
+	if current := follower.Status().CurrentVersion; current != 2 {
+		t.Fatalf("expected the follower to have applied version 2, got %d", current)
+	}
+	if current := leader.Status().CurrentVersion; current != 2 {
+		t.Fatalf("expected the leader to have applied version 2, got %d", current)
+	}
+
+	// Forwarded operations aren't forwarded again.
+	if _, err = follower.ApplyBatch(WithoutForwarding(context.Background()), []Operation{op}, false); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader, got %v", err)
+	}
+	// Waiting for the follower to apply the operations
+	// is limited by the timeout.
+	follower.SetForwarding(ForwardConfig{Forwarder: forwarder, WaitForApply: true, Timeout: 50 * time.Millisecond})
+	cancel()
+	version, err = follower.ApplyBatch(context.Background(), []Operation{op}, false)
+	if err != context.DeadlineExceeded || version != 3 {
+		t.Fatalf("expected version 3 and a timeout, got %d and %v", version, err)
+	}
+	follower.SetForwarding(ForwardConfig{Forwarder: forwarder, Leader: "c"})
+	if _, err = follower.ApplyBatch(context.Background(), []Operation{op}, false); err != ErrLeaderUnavailable {
+		t.Fatalf("expected ErrLeaderUnavailable from an unknown leader, got %v", err)
+	}
+}
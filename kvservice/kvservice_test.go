@@ -0,0 +1,251 @@
+package kvservice
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/Preetam/rig"
+)
+
+// apply validates and applies an operation at the next version.
+func apply(s *Service, op rig.Operation) error {
+	version, _ := s.Version()
+	err := s.Validate(op)
+	if err != nil {
+		return err
+	}
+	return s.Apply(version+1, op)
+}
+
+func keys(v *View, start, end string) []string {
+	result := []string{}
+	v.Range(start, end, func(key string, value []byte) bool {
+		result = append(result, key)
+		return true
+	})
+	return result
+}
+
+func TestService(t *testing.T) {
+	s := New()
+	for _, key := range []string{"b", "a", "c/1", "c/2", "c", "d"} {
+		if err := apply(s, Set(key, []byte("v"+key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	view := s.View()
+
+	if err := apply(s, Delete("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(s, CompareAndSet("b", []byte("vb"), []byte("vb2"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(s, CompareAndSet("b", []byte("vb"), []byte("vb3"))); err != ErrCompareFailed {
+		t.Fatalf("expected ErrCompareFailed, got %v", err)
+	}
+	if err := apply(s, CompareAndSet("e", nil, []byte("ve"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(s, CompareAndSet("e", nil, []byte("ve"))); err != ErrCompareFailed {
+		t.Fatalf("expected ErrCompareFailed, got %v", err)
+	}
+	if err := apply(s, DeleteRange("c/", "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(s, Set("", nil)); err != ErrEmptyKey {
+		t.Fatalf("expected ErrEmptyKey, got %v", err)
+	}
+
+	if version, _ := s.Version(); version != 10 {
+		t.Fatalf("expected version 10, got %d", version)
+	}
+	current := s.View()
+	if got := fmt.Sprint(keys(current, "", "")); got != "[b c d e]" {
+		t.Fatalf("unexpected keys %s", got)
+	}
+	if value, ok := current.Get("b"); !ok || string(value) != "vb2" {
+		t.Fatalf("unexpected value %q", value)
+	}
+
+	// The earlier view isn't affected by later operations.
+	if view.Version() != 6 || view.Len() != 6 {
+		t.Fatalf("unexpected view version %d with %d keys", view.Version(), view.Len())
+	}
+	if got := fmt.Sprint(keys(view, "b", "d")); got != "[b c c/1 c/2]" {
+		t.Fatalf("unexpected keys %s", got)
+	}
+	prefixed := []string{}
+	view.Prefix("c/", func(key string, value []byte) bool {
+		prefixed = append(prefixed, key)
+		return true
+	})
+	if got := fmt.Sprint(prefixed); got != "[c/1 c/2]" {
+		t.Fatalf("unexpected keys %s", got)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, end := range map[string]string{
+		"":         "",
+		"a":        "b",
+		"a\xff":    "b",
+		"\xff\xff": "",
+	} {
+		if got := prefixEnd(prefix); got != end {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", prefix, got, end)
+		}
+	}
+}
+
+func TestTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var root *node
+	expected := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprint(rng.Intn(1000))
+		switch rng.Intn(10) {
+		case 0:
+			end := fmt.Sprint(rng.Intn(1000))
+			root = root.deleteRange(key, end)
+			for k := range expected {
+				if k >= key && k < end {
+					delete(expected, k)
+				}
+			}
+		case 1, 2, 3:
+			root = root.delete(key)
+			delete(expected, key)
+		default:
+			root = root.insert(key, []byte(fmt.Sprint(i)))
+			expected[key] = fmt.Sprint(i)
+		}
+	}
+	if root.len() != len(expected) {
+		t.Fatalf("expected %d keys, got %d", len(expected), root.len())
+	}
+	expectedKeys := []string{}
+	for key := range expected {
+		expectedKeys = append(expectedKeys, key)
+	}
+	sort.Strings(expectedKeys)
+	got := keys(&View{root: root}, "", "")
+	if fmt.Sprint(got) != fmt.Sprint(expectedKeys) {
+		t.Fatalf("expected keys %v, got %v", expectedKeys, got)
+	}
+	for key, value := range expected {
+		if v, ok := root.get(key); !ok || string(v) != value {
+			t.Fatalf("expected %s=%s, got %q", key, value, v)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := New()
+	for i := 0; i < 1000; i++ {
+		if err := apply(s, Set(fmt.Sprintf("key%04d", i), bytes.Repeat([]byte{byte(i)}, i%7))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, size, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != size {
+		t.Fatalf("expected %d bytes, got %d", size, len(data))
+	}
+	written := bytes.NewBuffer(nil)
+	if _, err = s.View().WriteTo(written); err != nil || !bytes.Equal(written.Bytes(), data) {
+		t.Fatalf("expected WriteTo to write the snapshot (%v)", err)
+	}
+	// Operations applied after Snapshot don't change it, and
+	// it can be read again from any offset.
+	view := s.View()
+	if err = apply(s, Delete("key0500")); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 1, 100, size - 5, size} {
+		if _, err = r.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(rest, data[offset:]) {
+			t.Fatalf("unexpected snapshot after seeking to %d (%v)", offset, err)
+		}
+	}
+	if end, err := r.Seek(0, io.SeekEnd); err != nil || end != size {
+		t.Fatalf("expected the end at %d, got %d (%v)", size, end, err)
+	}
+
+	restored := New()
+	if err := restored.Restore(1000, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := restored.Version(); version != 1000 {
+		t.Fatalf("expected version 1000, got %d", version)
+	}
+	if fmt.Sprint(keys(restored.View(), "", "")) != fmt.Sprint(keys(view, "", "")) {
+		t.Fatal("restored keys don't match")
+	}
+	if value, _ := restored.Get("key0006"); !bytes.Equal(value, bytes.Repeat([]byte{6}, 6)) {
+		t.Fatalf("unexpected value %v", value)
+	}
+
+	if err := New().Restore(999, bytes.NewReader(data)); err == nil {
+		t.Fatal("expected a version mismatch error")
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)/2] ^= 1
+	if err := New().Restore(1000, bytes.NewReader(corrupt)); err != ErrInvalidSnapshot {
+		t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+	}
+	if err := New().Restore(1000, bytes.NewReader(data[:len(data)-1])); err != ErrInvalidSnapshot {
+		t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	digest := func(ops ...rig.Operation) []byte {
+		s := New()
+		for _, op := range ops {
+			if err := apply(s, op); err != nil {
+				t.Fatal(err)
+			}
+		}
+		digest, err := s.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	empty := digest()
+	ab := digest(Set("a", []byte("1")), Set("b", []byte("2")))
+	if bytes.Equal(empty, ab) {
+		t.Fatal("expected different digests for different states")
+	}
+	// The digest only depends on the state, not how it was reached.
+	for _, digest := range [][]byte{
+		digest(Set("b", []byte("2")), Set("a", []byte("1"))),
+		digest(Set("c", nil), Set("a", []byte("1")), Set("b", []byte("x")), Delete("c"), Set("b", []byte("2"))),
+		digest(Set("a", []byte("1")), Set("b", []byte("2")), Set("b1", nil), Set("b2", nil), DeleteRange("b1", "")),
+	} {
+		if !bytes.Equal(digest, ab) {
+			t.Fatalf("expected digest %x, got %x", ab, digest)
+		}
+	}
+	if bytes.Equal(digest(Set("a", []byte("1")), Set("b", []byte("3"))), ab) {
+		t.Fatal("expected a different digest for a different value")
+	}
+	if !bytes.Equal(digest(Set("a", nil), Delete("a")), empty) {
+		t.Fatal("expected the digest of an empty map after deleting every key")
+	}
+}
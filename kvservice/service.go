@@ -0,0 +1,302 @@
+// Package kvservice implements rig.Service for an ordered,
+// in-memory key/value map.
+//
+// Operations are created with Set, Delete, CompareAndSet and
+// DeleteRange. Reads go through a View, which is a consistent
+// point-in-time copy of the map that is not affected by later
+// operations. Within RiggedService.Read, ViewAt returns the view
+// at the version being read.
+package kvservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Preetam/rig"
+)
+
+// Operation methods.
+const (
+	MethodSet           = "set"
+	MethodDelete        = "delete"
+	MethodCompareAndSet = "compare-and-set"
+	MethodDeleteRange   = "delete-range"
+)
+
+var (
+	// ErrCompareFailed is returned when the current value of a key
+	// doesn't match the one expected by a compare-and-set operation.
+	ErrCompareFailed = errors.New("kvservice: compare failed")
+	// ErrEmptyKey is returned for operations with an empty key.
+	ErrEmptyKey = errors.New("kvservice: empty key")
+)
+
+func init() {
+	rig.RegisterService("kv", func() (rig.Service, error) {
+		return New(), nil
+	})
+}
+
+// Service is a rig.Service for an ordered key/value map.
+type Service struct {
+	router  *rig.Router
+	lock    sync.RWMutex
+	root    *node
+	version uint64
+	// retained has the views kept by RetainView.
+	retained map[uint64]*retainedView
+}
+
+type retainedView struct {
+	view *View
+	refs int
+}
+
+type setPayload struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type deletePayload struct {
+	Key string `json:"key"`
+}
+
+type compareAndSetPayload struct {
+	Key string `json:"key"`
+	// Old is the expected value, or nil if the key
+	// is expected to not exist.
+	Old []byte `json:"old"`
+	// New is the new value, or nil to delete the key.
+	New []byte `json:"new"`
+}
+
+type deleteRangePayload struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+var (
+	_ rig.Service  = &Service{}
+	_ rig.Viewer   = &Service{}
+	_ rig.Digester = &Service{}
+)
+
+// New returns an empty Service.
+func New() *Service {
+	s := &Service{
+		router: rig.NewRouter(),
+	}
+	s.router.Handle(MethodSet, s.applySet, validateSet)
+	s.router.Handle(MethodDelete, s.applyDelete, validateDelete)
+	s.router.Handle(MethodCompareAndSet, s.applyCompareAndSet, s.validateCompareAndSet)
+	s.router.Handle(MethodDeleteRange, s.applyDeleteRange, nil)
+	return s
+}
+
+// Set returns an operation that sets key to value.
+func Set(key string, value []byte) rig.Operation {
+	return operation(MethodSet, setPayload{Key: key, Value: value})
+}
+
+// Delete returns an operation that deletes key.
+func Delete(key string) rig.Operation {
+	return operation(MethodDelete, deletePayload{Key: key})
+}
+
+// CompareAndSet returns an operation that sets key to newValue if its
+// current value is oldValue. A nil oldValue expects the key to not exist,
+// and a nil newValue deletes the key.
+func CompareAndSet(key string, oldValue, newValue []byte) rig.Operation {
+	return operation(MethodCompareAndSet, compareAndSetPayload{Key: key, Old: oldValue, New: newValue})
+}
+
+// DeleteRange returns an operation that deletes the keys in
+// [start, end). An empty end deletes everything from start.
+func DeleteRange(start, end string) rig.Operation {
+	return operation(MethodDeleteRange, deleteRangePayload{Start: start, End: end})
+}
+
+func operation(method string, payload interface{}) rig.Operation {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		// The payloads only contain strings and byte slices.
+		panic(err)
+	}
+	return rig.Operation{Method: method, Data: data}
+}
+
+// Validate checks an operation against the state it is about to be
+// applied to, so compare-and-set operations that fail are rejected
+// before they are applied.
+func (s *Service) Validate(op rig.Operation) error {
+	return s.router.Validate(op)
+}
+
+func (s *Service) Apply(version uint64, op rig.Operation) error {
+	return s.router.Apply(version, op)
+}
+
+func (s *Service) Version() (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.version, nil
+}
+
+// View returns a consistent view of the current state.
+func (s *Service) View() *View {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return &View{
+		root:    s.root,
+		version: s.version,
+	}
+}
+
+// RetainView keeps the view at version readable with ViewAt until
+// release is called. It's called by RiggedService.Read.
+func (s *Service) RetainView(version uint64) func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.retained == nil {
+		s.retained = map[uint64]*retainedView{}
+	}
+	retained, ok := s.retained[version]
+	if !ok {
+		retained = &retainedView{view: &View{root: s.root, version: s.version}}
+		s.retained[version] = retained
+	}
+	retained.refs++
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		retained.refs--
+		if retained.refs == 0 {
+			delete(s.retained, version)
+		}
+	}
+}
+
+// ViewAt returns the view at version if it's the current
+// version or it's retained, and false otherwise.
+func (s *Service) ViewAt(version uint64) (*View, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if retained, ok := s.retained[version]; ok {
+		return retained.view, true
+	}
+	if version == s.version {
+		return &View{root: s.root, version: s.version}, true
+	}
+	return nil, false
+}
+
+// Get returns the current value of a key.
+func (s *Service) Get(key string) ([]byte, bool) {
+	return s.View().Get(key)
+}
+
+func (s *Service) update(version uint64, root *node) {
+	s.lock.Lock()
+	s.root = root
+	s.version = version
+	s.lock.Unlock()
+}
+
+func (s *Service) current() *node {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.root
+}
+
+func validateSet(p *setPayload) error {
+	if p.Key == "" {
+		return ErrEmptyKey
+	}
+	return nil
+}
+
+func (s *Service) applySet(version uint64, p *setPayload) error {
+	value := p.Value
+	if value == nil {
+		value = []byte{}
+	}
+	s.update(version, s.current().insert(p.Key, value))
+	return nil
+}
+
+func validateDelete(p *deletePayload) error {
+	if p.Key == "" {
+		return ErrEmptyKey
+	}
+	return nil
+}
+
+func (s *Service) applyDelete(version uint64, p *deletePayload) error {
+	s.update(version, s.current().delete(p.Key))
+	return nil
+}
+
+func (s *Service) validateCompareAndSet(p *compareAndSetPayload) error {
+	if p.Key == "" {
+		return ErrEmptyKey
+	}
+	return s.compare(s.current(), p)
+}
+
+func (s *Service) compare(root *node, p *compareAndSetPayload) error {
+	value, exists := root.get(p.Key)
+	if exists != (p.Old != nil) || !bytes.Equal(value, p.Old) {
+		return ErrCompareFailed
+	}
+	return nil
+}
+
+func (s *Service) applyCompareAndSet(version uint64, p *compareAndSetPayload) error {
+	root := s.current()
+	err := s.compare(root, p)
+	if err != nil {
+		return err
+	}
+	if p.New == nil {
+		root = root.delete(p.Key)
+	} else {
+		root = root.insert(p.Key, p.New)
+	}
+	s.update(version, root)
+	return nil
+}
+
+func (s *Service) applyDeleteRange(version uint64, p *deleteRangePayload) error {
+	s.update(version, s.current().deleteRange(p.Start, p.End))
+	return nil
+}
+
+// Snapshot returns a snapshot of the current state in the format
+// written by View.WriteTo. It's encoded from the view as it's read.
+func (s *Service) Snapshot() (io.ReadSeeker, int64, error) {
+	stream := s.View().snapshotStream()
+	return stream, stream.size, nil
+}
+
+// Digest returns a hash of the current state. It's kept up to date
+// as operations are applied, so it doesn't read the whole state.
+func (s *Service) Digest() ([]byte, error) {
+	return append([]byte(nil), s.current().subtreeHash()...), nil
+}
+
+// Restore replaces the state with a snapshot read from r.
+func (s *Service) Restore(version uint64, r io.Reader) error {
+	root, snapshotVersion, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if snapshotVersion != version {
+		return fmt.Errorf("kvservice: snapshot has version %d, expected %d", snapshotVersion, version)
+	}
+	s.update(version, root)
+	return nil
+}
@@ -0,0 +1,288 @@
+package kvservice
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Snapshot format:
+//
+//	magic      "RIGKV"
+//	format     1 byte
+//	version    uvarint
+//	count      uvarint
+//	entries    count * (uvarint key length, key, uvarint value length, value)
+//	checksum   CRC-32 (IEEE) of everything before it, big endian
+//
+// Entries are in ascending key order.
+const (
+	snapshotMagic  = "RIGKV"
+	snapshotFormat = 1
+)
+
+// ErrInvalidSnapshot is returned by Restore for snapshots
+// that are corrupt or in an unknown format.
+var ErrInvalidSnapshot = errors.New("kvservice: invalid snapshot")
+
+// WriteTo writes the view in the snapshot format.
+func (v *View) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, v.snapshotStream())
+}
+
+// snapshotStream reads a view in the snapshot format. Entries are encoded
+// as they are read, so the snapshot isn't held in memory, and the view
+// keeps the tree it reads from unchanged.
+type snapshotStream struct {
+	view *View
+	size int64
+	// offset is the position to read from next, and
+	// pos is the position of the start of buf.
+	offset int64
+	pos    int64
+	buf    []byte
+	chunk  []byte
+	crc    hash.Hash32
+	// stack has the nodes left to encode, the next one last.
+	stack []*node
+	step  streamStep
+}
+
+type streamStep int
+
+const (
+	streamHeader streamStep = iota
+	streamEntries
+	streamChecksum
+	streamDone
+)
+
+func (v *View) snapshotStream() *snapshotStream {
+	size := len(snapshotMagic) + 1 + uvarintLen(v.version) + uvarintLen(uint64(v.root.len())) + 4
+	return &snapshotStream{
+		view: v,
+		size: int64(size) + v.root.encodedLen(),
+		crc:  crc32.NewIEEE(),
+	}
+}
+
+func (s *snapshotStream) Read(p []byte) (int, error) {
+	if s.offset < s.pos {
+		s.rewind()
+	}
+	n := 0
+	for n < len(p) {
+		if len(s.buf) == 0 {
+			if !s.next() {
+				break
+			}
+			continue
+		}
+		if skip := s.offset - s.pos; skip > 0 {
+			if skip > int64(len(s.buf)) {
+				skip = int64(len(s.buf))
+			}
+			s.buf = s.buf[skip:]
+			s.pos += skip
+			continue
+		}
+		copied := copy(p[n:], s.buf)
+		s.buf = s.buf[copied:]
+		s.pos += int64(copied)
+		s.offset += int64(copied)
+		n += copied
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Seek sets the offset of the next Read. Seeking backwards
+// encodes the snapshot again from the start.
+func (s *snapshotStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("kvservice: negative snapshot offset")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *snapshotStream) rewind() {
+	s.pos = 0
+	s.buf = nil
+	s.stack = s.stack[:0]
+	s.crc.Reset()
+	s.step = streamHeader
+}
+
+// next encodes the next part of the snapshot into buf.
+// It returns false at the end of the snapshot.
+func (s *snapshotStream) next() bool {
+	chunk := s.chunk[:0]
+	switch s.step {
+	case streamHeader:
+		chunk = append(chunk, snapshotMagic...)
+		chunk = append(chunk, snapshotFormat)
+		chunk = appendUvarint(chunk, s.view.version)
+		chunk = appendUvarint(chunk, uint64(s.view.root.len()))
+		s.pushLeft(s.view.root)
+		s.step = streamEntries
+	case streamEntries:
+		if len(s.stack) == 0 {
+			s.step = streamChecksum
+			return s.next()
+		}
+		n := s.stack[len(s.stack)-1]
+		s.stack = s.stack[:len(s.stack)-1]
+		s.pushLeft(n.right)
+		chunk = appendBytes(chunk, []byte(n.key))
+		chunk = appendBytes(chunk, n.value)
+	case streamChecksum:
+		chunk = append(chunk, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(chunk, s.crc.Sum32())
+		s.step = streamDone
+	default:
+		return false
+	}
+	if s.step != streamDone {
+		s.crc.Write(chunk)
+	}
+	s.chunk = chunk
+	s.buf = chunk
+	return true
+}
+
+// pushLeft pushes n and its left descendants.
+func (s *snapshotStream) pushLeft(n *node) {
+	for ; n != nil; n = n.left {
+		s.stack = append(s.stack, n)
+	}
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], x)]...)
+}
+
+// readSnapshot reads a snapshot and returns its tree and version.
+func readSnapshot(r io.Reader) (*node, uint64, error) {
+	sr := &snapshotReader{
+		r:   bufio.NewReader(r),
+		crc: crc32.NewIEEE(),
+	}
+	header := make([]byte, len(snapshotMagic)+1)
+	if err := sr.read(header); err != nil {
+		return nil, 0, err
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, 0, ErrInvalidSnapshot
+	}
+	if header[len(snapshotMagic)] != snapshotFormat {
+		return nil, 0, fmt.Errorf("kvservice: unknown snapshot format %d", header[len(snapshotMagic)])
+	}
+	version, err := sr.readUvarint()
+	if err != nil {
+		return nil, 0, err
+	}
+	count, err := sr.readUvarint()
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		root    *node
+		lastKey string
+	)
+	for i := uint64(0); i < count; i++ {
+		key, err := sr.readBytes()
+		if err != nil {
+			return nil, 0, err
+		}
+		if i > 0 && string(key) <= lastKey {
+			return nil, 0, ErrInvalidSnapshot
+		}
+		value, err := sr.readBytes()
+		if err != nil {
+			return nil, 0, err
+		}
+		lastKey = string(key)
+		root = root.insert(lastKey, value)
+	}
+	sum := sr.crc.Sum32()
+	checksum := make([]byte, 4)
+	if err := sr.read(checksum); err != nil {
+		return nil, 0, err
+	}
+	if binary.BigEndian.Uint32(checksum) != sum {
+		return nil, 0, ErrInvalidSnapshot
+	}
+	return root, version, nil
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (sr *snapshotReader) read(p []byte) error {
+	_, err := io.ReadFull(sr.r, p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidSnapshot
+	}
+	if err != nil {
+		return err
+	}
+	sr.crc.Write(p)
+	return nil
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == io.EOF {
+		return 0, ErrInvalidSnapshot
+	}
+	if err != nil {
+		return 0, err
+	}
+	sr.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (sr *snapshotReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(sr)
+}
+
+// readBytes reads a length-prefixed byte string. The length is only
+// trusted up to what the reader can actually provide, so a corrupt
+// length doesn't cause a huge allocation.
+func (sr *snapshotReader) readBytes() ([]byte, error) {
+	n, err := sr.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{}
+	for n > 0 {
+		chunk := n
+		if chunk > 1<<20 {
+			chunk = 1 << 20
+		}
+		p := make([]byte, chunk)
+		err = sr.read(p)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, p...)
+		n -= chunk
+	}
+	return buf, nil
+}
@@ -0,0 +1,235 @@
+package kvservice
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// node is a node of a persistent treap ordered by key. Nodes are never
+// modified after they are created, so a root is a consistent point-in-time
+// view of the map. Priorities are derived from keys, which makes the shape
+// of the tree depend only on its contents.
+type node struct {
+	key      string
+	value    []byte
+	priority uint64
+	size     int
+	left     *node
+	right    *node
+	// encodedSize is the size of the subtree's entries in the
+	// snapshot format.
+	encodedSize int64
+	// entryHash is the hash of the key and value, and hash is the
+	// hash of the subtree, from entryHash and the children's hashes.
+	// Since the shape of the tree depends only on its contents, so
+	// does the hash of the root.
+	entryHash [sha256.Size]byte
+	hash      [sha256.Size]byte
+}
+
+func newNode(key string, value []byte, priority uint64, left, right *node) *node {
+	return link(&node{
+		key:       key,
+		value:     value,
+		priority:  priority,
+		entryHash: hashEntry(key, value),
+	}, left, right)
+}
+
+// withChildren returns a copy of n with different children.
+func (n *node) withChildren(left, right *node) *node {
+	return link(&node{
+		key:       n.key,
+		value:     n.value,
+		priority:  n.priority,
+		entryHash: n.entryHash,
+	}, left, right)
+}
+
+// link sets the children of a new node and the fields that depend on them.
+func link(n, left, right *node) *node {
+	n.left = left
+	n.right = right
+	n.size = 1 + left.len() + right.len()
+	n.encodedSize = encodedEntrySize(n.key, n.value) + left.encodedLen() + right.encodedLen()
+	buf := make([]byte, 0, 3*sha256.Size)
+	buf = append(buf, left.subtreeHash()...)
+	buf = append(buf, n.entryHash[:]...)
+	buf = append(buf, right.subtreeHash()...)
+	n.hash = sha256.Sum256(buf)
+	return n
+}
+
+func hashEntry(key string, value []byte) [sha256.Size]byte {
+	buf := make([]byte, 0, encodedEntrySize(key, value))
+	buf = appendBytes(buf, []byte(key))
+	buf = appendBytes(buf, value)
+	return sha256.Sum256(buf)
+}
+
+// encodedEntrySize returns the size of an entry in the snapshot format.
+func encodedEntrySize(key string, value []byte) int64 {
+	return int64(uvarintLen(uint64(len(key))) + len(key) + uvarintLen(uint64(len(value))) + len(value))
+}
+
+// appendBytes appends a length-prefixed byte string.
+func appendBytes(buf, p []byte) []byte {
+	return append(appendUvarint(buf, uint64(len(p))), p...)
+}
+
+func uvarintLen(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+func (n *node) encodedLen() int64 {
+	if n == nil {
+		return 0
+	}
+	return n.encodedSize
+}
+
+// subtreeHash returns the hash of the subtree,
+// which is all zeros for an empty one.
+func (n *node) subtreeHash() []byte {
+	if n == nil {
+		return make([]byte, sha256.Size)
+	}
+	return n.hash[:]
+}
+
+func keyPriority(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (n *node) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func (n *node) get(key string) ([]byte, bool) {
+	for n != nil {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n.value, true
+		}
+	}
+	return nil, false
+}
+
+// insert returns a tree with key set to value.
+func (n *node) insert(key string, value []byte) *node {
+	if n == nil {
+		return newNode(key, value, keyPriority(key), nil, nil)
+	}
+	switch {
+	case key < n.key:
+		left := n.left.insert(key, value)
+		if left.priority > n.priority {
+			// Rotate right.
+			return left.withChildren(left.left, n.withChildren(left.right, n.right))
+		}
+		return n.withChildren(left, n.right)
+	case key > n.key:
+		right := n.right.insert(key, value)
+		if right.priority > n.priority {
+			// Rotate left.
+			return right.withChildren(n.withChildren(n.left, right.left), right.right)
+		}
+		return n.withChildren(n.left, right)
+	}
+	return newNode(key, value, n.priority, n.left, n.right)
+}
+
+// delete returns a tree without key.
+func (n *node) delete(key string) *node {
+	if n == nil {
+		return nil
+	}
+	switch {
+	case key < n.key:
+		left := n.left.delete(key)
+		if left == n.left {
+			return n
+		}
+		return n.withChildren(left, n.right)
+	case key > n.key:
+		right := n.right.delete(key)
+		if right == n.right {
+			return n
+		}
+		return n.withChildren(n.left, right)
+	}
+	return merge(n.left, n.right)
+}
+
+// split returns the trees with the keys less than key
+// and the keys greater than or equal to key.
+func (n *node) split(key string) (*node, *node) {
+	if n == nil {
+		return nil, nil
+	}
+	if n.key < key {
+		left, right := n.right.split(key)
+		return n.withChildren(n.left, left), right
+	}
+	left, right := n.left.split(key)
+	return left, n.withChildren(right, n.right)
+}
+
+// merge joins two trees where every key in a
+// is less than every key in b.
+func merge(a, b *node) *node {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.priority > b.priority:
+		return a.withChildren(a.left, merge(a.right, b))
+	}
+	return b.withChildren(merge(a, b.left), b.right)
+}
+
+// deleteRange returns a tree without the keys in [start, end).
+// An empty end has no upper bound.
+func (n *node) deleteRange(start, end string) *node {
+	left, rest := n.split(start)
+	if end == "" {
+		return left
+	}
+	_, right := rest.split(end)
+	return merge(left, right)
+}
+
+// ascend calls fn for the keys in [start, end) in order until
+// it returns false. An empty end has no upper bound. It returns
+// false if fn stopped the iteration or a key past end was reached.
+func (n *node) ascend(start, end string, fn func(key string, value []byte) bool) bool {
+	if n == nil {
+		return true
+	}
+	if start < n.key {
+		if !n.left.ascend(start, end, fn) {
+			return false
+		}
+	}
+	if end != "" && n.key >= end {
+		return false
+	}
+	if n.key >= start {
+		if !fn(n.key, n.value) {
+			return false
+		}
+	}
+	return n.right.ascend(start, end, fn)
+}
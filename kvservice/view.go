@@ -0,0 +1,48 @@
+package kvservice
+
+// View is a consistent point-in-time view of a Service.
+// Values returned by a View must not be modified.
+type View struct {
+	root    *node
+	version uint64
+}
+
+// Version returns the version of the last operation in the view.
+func (v *View) Version() uint64 {
+	return v.version
+}
+
+// Len returns the number of keys.
+func (v *View) Len() int {
+	return v.root.len()
+}
+
+// Get returns the value of a key.
+func (v *View) Get(key string) ([]byte, bool) {
+	return v.root.get(key)
+}
+
+// Range calls fn for the keys in [start, end) in order until it
+// returns false. An empty end has no upper bound.
+func (v *View) Range(start, end string, fn func(key string, value []byte) bool) {
+	v.root.ascend(start, end, fn)
+}
+
+// Prefix calls fn for the keys starting with prefix in order
+// until it returns false.
+func (v *View) Prefix(prefix string, fn func(key string, value []byte) bool) {
+	v.root.ascend(prefix, prefixEnd(prefix), fn)
+}
+
+// prefixEnd returns the first key after all of the keys
+// starting with prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package rig_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Preetam/rig"
+	"github.com/Preetam/rig/kvservice"
+)
+
+func newKVService(t *testing.T, dir string) (*rig.RiggedService, *kvservice.Service) {
+	service := kvservice.New()
+	rs, err := rig.NewRiggedService(service, rig.NewFileObjectStore(dir), "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rig.DisableRecoverSleep(rs)
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	return rs, service
+}
+
+func TestKVServiceRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rs, _ := newKVService(t, dir)
+	for i := 0; i < 10; i++ {
+		if err = rs.Apply(kvservice.Set(fmt.Sprint("key", i), []byte{byte(i)}), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = rs.ApplyBatch(context.Background(), []rig.Operation{
+		kvservice.DeleteRange("key2", "key5"),
+		kvservice.CompareAndSet("key9", []byte{9}, []byte("nine")),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rs.Apply(kvservice.CompareAndSet("key9", []byte{9}, nil), false)
+	if _, ok := err.(rig.ValidationError); !ok {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	// Each operation is validated against the state left by the ones
+	// before it, and the ones before a failed one stay applied.
+	version, err := rs.ApplyBatch(context.Background(), []rig.Operation{
+		kvservice.Set("key10", []byte("x")),
+		kvservice.CompareAndSet("key10", []byte("x"), []byte("y")),
+		kvservice.CompareAndSet("key10", []byte("x"), []byte("z")),
+	}, false)
+	if _, ok := err.(rig.ValidationError); !ok || version != 14 {
+		t.Fatalf("expected a ValidationError after version 14, got %d and %v", version, err)
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, recovered := newKVService(t, dir)
+	view := recovered.View()
+	if view.Version() != 14 || view.Len() != 8 {
+		t.Fatalf("unexpected recovered version %d with %d keys", view.Version(), view.Len())
+	}
+	if value, _ := view.Get("key9"); string(value) != "nine" {
+		t.Fatalf("unexpected value %q", value)
+	}
+	if value, _ := view.Get("key10"); string(value) != "y" {
+		t.Fatalf("unexpected value %q", value)
+	}
+	if _, ok := view.Get("key3"); ok {
+		t.Fatal("expected key3 to be deleted")
+	}
+}
+
+func TestKVServiceRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rs, service := newKVService(t, dir)
+	if err = rs.Apply(kvservice.Set("a", []byte("1")), false); err != nil {
+		t.Fatal(err)
+	}
+	// Operations are applied while the view is read.
+	err = rs.Read(func(version uint64) error {
+		if err := rs.Apply(kvservice.Set("a", []byte("2")), false); err != nil {
+			return err
+		}
+		view, ok := service.ViewAt(version)
+		if !ok {
+			t.Fatalf("expected version %d to be retained", version)
+		}
+		if value, _ := view.Get("a"); string(value) != "1" {
+			t.Fatalf("expected to read the value at version %d, got %q", version, value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := service.ViewAt(1); ok {
+		t.Fatal("expected version 1 to be released")
+	}
+	if value, _ := service.Get("a"); string(value) != "2" {
+		t.Fatalf("unexpected value %q", value)
+	}
+}
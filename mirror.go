@@ -0,0 +1,230 @@
+package rig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Mirror copies the objects under a prefix from a primary object store
+// to secondary stores. Objects are copied in version order so that each
+// secondary is always a valid prefix to recover from: a log record is
+// only copied after its predecessors, and LATEST is only updated after
+// the snapshot it points to.
+//
+// Each secondary stores the progress of the mirror in a MIRROR
+// object under the prefix.
+type Mirror struct {
+	source       ObjectStore
+	prefix       string
+	destinations []ObjectStore
+
+	// OnError, if set, is called with errors from
+	// synchronization passes started by Run.
+	OnError func(error)
+
+	lock        sync.Mutex
+	checkpoints []*mirrorCheckpoint
+}
+
+type mirrorCheckpoint struct {
+	// Snapshot is the version of the last copied snapshot.
+	Snapshot uint64 `json:"snapshot"`
+	// Next is the version of the next log record to copy.
+	Next uint64 `json:"next"`
+}
+
+func NewMirror(source ObjectStore, prefix string, destinations ...ObjectStore) *Mirror {
+	return &Mirror{
+		source:       source,
+		prefix:       prefix,
+		destinations: destinations,
+		checkpoints:  make([]*mirrorCheckpoint, len(destinations)),
+	}
+}
+
+// Run synchronizes the destinations every interval
+// until the context is done.
+func (m *Mirror) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := m.Sync()
+		if err != nil && m.OnError != nil {
+			m.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync copies everything that is new in the source to each destination.
+// It returns the first error encountered, after trying every destination.
+func (m *Mirror) Sync() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	source := NewArchive(m.source, m.prefix)
+	latest, err := source.LatestSnapshotVersion()
+	if err != nil {
+		if !IsNotExist(err) {
+			return err
+		}
+		latest = 0
+	}
+	records, err := source.LogRecords()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for i := range m.destinations {
+		err = m.syncDestination(i, latest, records)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m *Mirror) syncDestination(i int, latest uint64, records []LogRecord) error {
+	destination := m.destinations[i]
+	checkpoint := m.checkpoints[i]
+	if checkpoint == nil {
+		err := createDirectories(destination, m.prefix)
+		if err != nil {
+			return err
+		}
+		checkpoint, err = m.loadCheckpoint(destination)
+		if err != nil {
+			return err
+		}
+		m.checkpoints[i] = checkpoint
+	}
+	saved := *checkpoint
+
+	if latest > checkpoint.Snapshot {
+		err := m.copyObject(destination, snapshotName(m.prefix, latest))
+		if err != nil {
+			return err
+		}
+		err = m.copyObject(destination, snapshotManifestName(m.prefix, latest))
+		if err != nil && err != errDoesNotExist {
+			return err
+		}
+		// Write LATEST ourselves since the source may
+		// have moved on to a snapshot we haven't copied.
+		latestFileContents := []byte(strconv.FormatUint(latest, 16))
+		err = destination.PutObject(latestObjectName(m.prefix), bytes.NewReader(latestFileContents), int64(len(latestFileContents)))
+		if err != nil {
+			return err
+		}
+		checkpoint.Snapshot = latest
+		if checkpoint.Next <= latest {
+			// Older log records aren't needed to recover.
+			checkpoint.Next = latest + 1
+		}
+	}
+
+	var err error
+	for _, record := range records {
+		if record.Timestamp > 0 || record.Version < checkpoint.Next {
+			continue
+		}
+		if record.Version > checkpoint.Next {
+			// Wait for the predecessor to show up.
+			break
+		}
+		var data []byte
+		data, err = m.readObject(record.Name)
+		if err != nil {
+			break
+		}
+		var batch logBatch
+		batch, err = decodeLogBatch(bytes.NewReader(data))
+		if err != nil {
+			break
+		}
+		err = destination.PutObject(record.Name, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			break
+		}
+		checkpoint.Next += uint64(len(batch.Operations))
+	}
+
+	if *checkpoint != saved {
+		saveErr := m.saveCheckpoint(destination, checkpoint)
+		if err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+func (m *Mirror) checkpointName() string {
+	return filepath.Join(m.prefix, "MIRROR")
+}
+
+func (m *Mirror) loadCheckpoint(destination ObjectStore) (*mirrorCheckpoint, error) {
+	checkpoint := &mirrorCheckpoint{Next: 1}
+	r, err := destination.GetObject(m.checkpointName())
+	if err != nil {
+		if IsNotExist(err) {
+			return checkpoint, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+	err = json.NewDecoder(r).Decode(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+func (m *Mirror) saveCheckpoint(destination ObjectStore, checkpoint *mirrorCheckpoint) error {
+	b, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return destination.PutObject(m.checkpointName(), bytes.NewReader(b), int64(len(b)))
+}
+
+func (m *Mirror) readObject(name string) ([]byte, error) {
+	r, err := m.source.GetObject(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (m *Mirror) copyObject(destination ObjectStore, name string) error {
+	data, err := m.readObject(name)
+	if err != nil {
+		return err
+	}
+	return destination.PutObject(name, bytes.NewReader(data), int64(len(data)))
+}
+
+// Progress returns the next log version each destination is waiting
+// for, or 0 for destinations that have not been synchronized yet.
+func (m *Mirror) Progress() []uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	progress := make([]uint64, len(m.checkpoints))
+	for i, checkpoint := range m.checkpoints {
+		if checkpoint != nil {
+			progress[i] = checkpoint.Next
+		}
+	}
+	return progress
+}
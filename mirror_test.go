@@ -0,0 +1,80 @@
+package rig
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	primaryDir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(primaryDir)
+	secondaryDir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(secondaryDir)
+	primary := NewFileObjectStore(primaryDir)
+	secondary := NewFileObjectStore(secondaryDir)
+
+	rs, err := NewRiggedService(&testService{}, primary, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(Operation{}, false)
+	rs.Apply(Operation{}, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Leave a gap at version 3 by writing a record for version 4 directly.
+	putLogBatch(t, primary, logRecordName("svc", 4), []Operation{{}})
+
+	mirror := NewMirror(primary, "svc", secondary)
+	if err = mirror.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if progress := mirror.Progress(); progress[0] != 3 {
+		t.Fatalf("expected the mirror to wait for version 3, got %d", progress[0])
+	}
+	archive := NewArchive(secondary, "svc")
+	if _, err = archive.ReadLogBatch(4); !IsNotExist(err) {
+		t.Fatalf("expected the record after the gap to be skipped, got %v", err)
+	}
+
+	putLogBatch(t, primary, logRecordName("svc", 3), []Operation{{}})
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// A new mirror resumes from the checkpoint in the secondary.
+	mirror = NewMirror(primary, "svc", secondary)
+	if err = mirror.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if progress := mirror.Progress(); progress[0] != 5 {
+		t.Fatalf("expected the mirror to wait for version 5, got %d", progress[0])
+	}
+	report, err := archive.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.SnapshotVersion != 2 || report.LastVersion != 4 {
+		t.Fatalf("unexpected secondary report %+v", report)
+	}
+
+	// The secondary can be recovered from.
+	service := &testService{}
+	recovered, err := NewRiggedService(service, secondary, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered.testSleep = true
+	if err = recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if service.version != 4 {
+		t.Fatalf("expected recovered version 4, got %d", service.version)
+	}
+}
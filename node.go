@@ -0,0 +1,521 @@
+package rig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned when a follower is asked to
+	// apply, flush or snapshot operations.
+	ErrNotLeader = errors.New("rig: not the leader")
+	// ErrLeaseLost is returned by Node.Run when the node loses its lease
+	// with operations that weren't flushed. The service has applied
+	// versions that another leader may reuse, so it must be recovered
+	// from a new process.
+	ErrLeaseLost = errors.New("rig: lease lost with unflushed operations")
+)
+
+// Role is whether a RiggedService accepts writes.
+type Role int
+
+const (
+	// Leader applies operations and writes them to the object store.
+	// Services that aren't run by a Node are always leaders.
+	Leader Role = iota
+	// Follower applies the operations written by the leader.
+	Follower
+)
+
+func (r Role) String() string {
+	switch r {
+	case Leader:
+		return "leader"
+	case Follower:
+		return "follower"
+	}
+	return "unknown"
+}
+
+// NodeConfig configures a Node. Zero durations use defaults.
+type NodeConfig struct {
+	// ID identifies the node in the lease. It must be unique.
+	ID string
+	// Address is stored in the lease while the node is the leader,
+	// so followers can forward operations to it. Its format depends
+	// on the Forwarder.
+	Address string
+
+	// LeaseDuration is how long a lease is held without being
+	// renewed. The default is 10 seconds.
+	LeaseDuration time.Duration
+	// RenewInterval is how often the leader renews its lease.
+	// The default is a third of LeaseDuration.
+	RenewInterval time.Duration
+	// ClockSkew is the maximum difference between the clocks of
+	// nodes. A leader stops writing ClockSkew before its lease expires,
+	// and followers wait ClockSkew after it expires to take it over.
+	// The default is 1 second.
+	ClockSkew time.Duration
+	// PollInterval is how often a follower reads new log records
+	// and checks the lease. The default is 1 second.
+	PollInterval time.Duration
+
+	// OnRoleChange, if set, is called when the node
+	// becomes the leader or a follower.
+	OnRoleChange func(role Role, epoch uint64)
+	// OnError, if set, is called with errors from Run that
+	// don't stop it, like failing to read the log.
+	OnError func(error)
+}
+
+// Node runs a RiggedService as a hot standby that takes over when
+// the leader goes away. Nodes that share a prefix compete for a lease
+// stored in a LEASE object. The node that holds it is the leader and
+// its service accepts writes; the others are followers that apply the
+// log records as the leader writes them.
+//
+// A node that acquires the lease replays the log to the end, increments
+// the epoch in the lease, and then becomes the leader. If the object
+// store implements ConditionalWriter, the lease is only written if it
+// hasn't changed since the node read it, so only one node can acquire
+// or renew it. Otherwise a node that writes the lease waits ClockSkew
+// and reads it back to make sure no other node wrote it at the same
+// time, which assumes that writes to the object store become visible
+// to every reader within ClockSkew. Either way, a leader reads the lease
+// before writing each log record, and stops writing if another node
+// has acquired it.
+type Node struct {
+	rs     *RiggedService
+	config NodeConfig
+	// conditional is the object store if it supports conditional
+	// writes. It is only changed while holding tickLock.
+	conditional ConditionalWriter
+
+	// tickLock serializes ticks and StepDown, which read and write
+	// the lease while holding it.
+	tickLock sync.Mutex
+	// deadline is when the leader stops writing
+	// unless it renews its lease.
+	deadline  time.Time
+	lastRenew time.Time
+	// holdOff is when a node that stepped down
+	// can try to acquire the lease again.
+	holdOff time.Time
+
+	// role and epoch are changed while holding both locks,
+	// so either one can be held to read them.
+	lock  sync.Mutex
+	role  Role
+	epoch uint64
+}
+
+type lease struct {
+	Holder  string `json:"holder"`
+	Address string `json:"address,omitempty"`
+	Epoch   uint64 `json:"epoch"`
+	// Expires is when the lease expires in Unix nanoseconds,
+	// or 0 if it was released.
+	Expires int64 `json:"expires"`
+}
+
+// NewNode returns a node for rs, which becomes a follower until
+// the node acquires the lease.
+func NewNode(rs *RiggedService, config NodeConfig) *Node {
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = 10 * time.Second
+	}
+	if config.RenewInterval <= 0 {
+		config.RenewInterval = config.LeaseDuration / 3
+	}
+	if config.ClockSkew <= 0 {
+		config.ClockSkew = time.Second
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	rs.lock.Lock()
+	rs.role = Follower
+	rs.publishStatus()
+	rs.lock.Unlock()
+	conditional, _ := rs.objectStore.(ConditionalWriter)
+	return &Node{
+		rs:          rs,
+		config:      config,
+		conditional: conditional,
+		role:        Follower,
+	}
+}
+
+// Service returns the node's service.
+func (n *Node) Service() *RiggedService {
+	return n.rs
+}
+
+// Role returns the node's role and epoch.
+func (n *Node) Role() (Role, uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role, n.epoch
+}
+
+// Run recovers the service and then follows the log and competes for
+// the lease until the context is done. When the context is done, a
+// leader stops renewing the lease but keeps it until it expires; call
+// StepDown first to hand it over sooner. Run returns ErrDivergence if
+// the state of a follower doesn't match the leader's, and ChainError
+// if a log record fails verification.
+func (n *Node) Run(ctx context.Context) error {
+	err := n.rs.Recover()
+	if err != nil {
+		return err
+	}
+	for {
+		interval, err := n.tick()
+		if untrusted(err) || err == ErrLeaseLost {
+			return err
+		}
+		if err != nil && n.config.OnError != nil {
+			n.config.OnError(err)
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// tick renews the lease of a leader, or catches up a follower and
+// tries to acquire the lease. It returns how long to wait until the
+// next tick.
+func (n *Node) tick() (time.Duration, error) {
+	n.tickLock.Lock()
+	changed := false
+	var err error
+	if n.role == Leader {
+		changed, err = n.renew()
+	} else {
+		changed, err = n.follow()
+	}
+	role, epoch := n.role, n.epoch
+	interval := n.config.PollInterval
+	if role == Leader {
+		interval = n.config.RenewInterval
+		if untilDeadline := time.Until(n.deadline); untilDeadline < interval {
+			interval = untilDeadline
+		}
+	}
+	n.tickLock.Unlock()
+	if changed && n.config.OnRoleChange != nil {
+		n.config.OnRoleChange(role, epoch)
+	}
+	return interval, err
+}
+
+// renew renews the lease, or makes the node a follower if it can't
+// renew it before the deadline. The caller must hold n.tickLock.
+func (n *Node) renew() (bool, error) {
+	if time.Since(n.lastRenew) >= n.config.RenewInterval {
+		start := time.Now()
+		current, etag, err := n.readLease()
+		if err == nil && (current.Holder != n.config.ID || current.Epoch != n.epoch) {
+			// Another node took the lease.
+			return true, n.demote()
+		}
+		if err == nil {
+			err = n.writeLease(lease{
+				Holder:  n.config.ID,
+				Epoch:   n.epoch,
+				Expires: start.Add(n.config.LeaseDuration).UnixNano(),
+			}, etag)
+		}
+		if err == ErrPreconditionFailed {
+			// Another node took the lease since it was read.
+			return true, n.demote()
+		}
+		if err == nil {
+			n.lastRenew = start
+			n.deadline = start.Add(n.config.LeaseDuration - n.config.ClockSkew)
+			n.rs.lock.Lock()
+			n.rs.leaseDeadline = n.deadline
+			n.rs.lock.Unlock()
+			return false, nil
+		}
+		if time.Now().Before(n.deadline) {
+			return false, err
+		}
+	}
+	if time.Now().Before(n.deadline) {
+		return false, nil
+	}
+	return true, n.demote()
+}
+
+// demote makes a leader that lost its lease a follower.
+// The caller must hold n.tickLock.
+func (n *Node) demote() error {
+	n.setRole(Follower, n.epoch)
+	n.rs.lock.Lock()
+	defer n.rs.lock.Unlock()
+	n.rs.role = Follower
+	n.rs.leaseHolder = ""
+	n.rs.publishStatus()
+	if len(n.rs.pending) > 0 || n.rs.inFlight != nil {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// follow applies new log records and acquires the lease if it's
+// available. The caller must hold n.tickLock.
+func (n *Node) follow() (bool, error) {
+	n.rs.lock.Lock()
+	err := n.rs.catchUp()
+	n.rs.lock.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if time.Now().Before(n.holdOff) {
+		return false, nil
+	}
+
+	current, etag, err := n.readLease()
+	if err != nil && err != errDoesNotExist {
+		return false, err
+	}
+	now := time.Now()
+	if err == nil && current.Holder != n.config.ID &&
+		now.Before(time.Unix(0, current.Expires).Add(n.config.ClockSkew)) {
+		return false, nil
+	}
+	acquired := lease{
+		Holder:  n.config.ID,
+		Address: n.config.Address,
+		Epoch:   current.Epoch + 1,
+		Expires: now.Add(n.config.LeaseDuration).UnixNano(),
+	}
+	err = n.writeLease(acquired, etag)
+	if err == ErrPreconditionFailed {
+		// Another node acquired it first.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if n.conditional == nil {
+		time.Sleep(n.config.ClockSkew)
+		current, _, err = n.readLease()
+		if err != nil {
+			return false, err
+		}
+		if current != acquired {
+			// Another node acquired it at the same time.
+			return false, nil
+		}
+	}
+	return true, n.promote(now, acquired.Epoch)
+}
+
+// promote replays the log written by the previous leader and makes the
+// node the leader. The caller must hold n.tickLock.
+func (n *Node) promote(acquired time.Time, epoch uint64) error {
+	n.rs.lock.Lock()
+	defer n.rs.lock.Unlock()
+	err := n.rs.catchUp()
+	if err != nil {
+		// Give up the lease by letting it expire,
+		// since it can't be released safely yet.
+		return err
+	}
+	if n.rs.chainHead == nil {
+		// A ReplicaClient applied the last log record without reading
+		// it, so the next one has to continue the chain from the log.
+		err = n.rs.loadChainHead(n.rs.Archive())
+		if err != nil {
+			return err
+		}
+	}
+	n.lastRenew = acquired
+	n.deadline = acquired.Add(n.config.LeaseDuration - n.config.ClockSkew)
+	n.rs.role = Leader
+	n.rs.epoch = epoch
+	n.rs.leaseDeadline = n.deadline
+	n.rs.leaseHolder = n.config.ID
+	n.rs.firstFlush = true
+	n.rs.publishStatus()
+	n.setRole(Leader, epoch)
+	return nil
+}
+
+// setRole changes the role and epoch of the node.
+// The caller must hold n.tickLock.
+func (n *Node) setRole(role Role, epoch uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.role = role
+	n.epoch = epoch
+}
+
+// StepDown flushes the pending operations, makes the node a follower,
+// and releases the lease so another node can acquire it. The node
+// doesn't try to acquire the lease again for LeaseDuration.
+func (n *Node) StepDown() error {
+	n.tickLock.Lock()
+	if n.role != Leader {
+		n.tickLock.Unlock()
+		return nil
+	}
+	n.rs.lock.Lock()
+	_, err := n.rs.flush()
+	if err == nil {
+		n.rs.role = Follower
+		n.rs.leaseHolder = ""
+	}
+	n.rs.publishStatus()
+	n.rs.lock.Unlock()
+	if err != nil {
+		n.tickLock.Unlock()
+		return err
+	}
+	epoch := n.epoch
+	n.setRole(Follower, epoch)
+	n.holdOff = time.Now().Add(n.config.LeaseDuration)
+	current, etag, err := n.readLease()
+	if err == nil && current.Holder == n.config.ID && current.Epoch == epoch {
+		err = n.writeLease(lease{Holder: n.config.ID, Epoch: epoch}, etag)
+	}
+	if err == ErrPreconditionFailed || err == errDoesNotExist {
+		// Another node took the lease, so it isn't released.
+		err = nil
+	}
+	n.tickLock.Unlock()
+	if n.config.OnRoleChange != nil {
+		n.config.OnRoleChange(Follower, epoch)
+	}
+	return err
+}
+
+func leaseObjectName(prefix string) string {
+	return filepath.Join(prefix, "LEASE")
+}
+
+func readLease(objectStore ObjectStore, prefix string) (lease, error) {
+	r, err := objectStore.GetObject(leaseObjectName(prefix))
+	if err != nil {
+		return lease{}, err
+	}
+	return decodeLease(r)
+}
+
+func decodeLease(r io.ReadCloser) (lease, error) {
+	defer r.Close()
+	l := lease{}
+	err := json.NewDecoder(r).Decode(&l)
+	return l, err
+}
+
+// readLease reads the lease, and its ETag if the object store
+// supports conditional writes. The caller must hold n.tickLock.
+func (n *Node) readLease() (lease, string, error) {
+	if n.conditional != nil {
+		r, etag, err := n.conditional.GetObjectETag(leaseObjectName(n.rs.prefix))
+		if err != ErrConditionalUnsupported {
+			if err != nil {
+				return lease{}, "", err
+			}
+			l, err := decodeLease(r)
+			return l, etag, err
+		}
+		n.conditional = nil
+	}
+	l, err := readLease(n.rs.objectStore, n.rs.prefix)
+	return l, "", err
+}
+
+// writeLease writes the lease if it hasn't changed since it was read
+// with etag, if the object store supports conditional writes, and
+// returns ErrPreconditionFailed if it has. The caller must hold
+// n.tickLock.
+func (n *Node) writeLease(l lease, etag string) error {
+	l.Address = n.config.Address
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	name := leaseObjectName(n.rs.prefix)
+	if n.conditional != nil {
+		err = n.conditional.PutObjectIfMatch(name, bytes.NewReader(b), int64(len(b)), etag)
+		if err != ErrConditionalUnsupported {
+			return err
+		}
+		n.conditional = nil
+	}
+	return n.rs.objectStore.PutObject(name, bytes.NewReader(b), int64(len(b)))
+}
+
+// catchUp applies the log records written since the last one was
+// applied, restoring a newer snapshot if the log doesn't continue
+// from the current version. The caller must hold rs.lock.
+func (rs *RiggedService) catchUp() error {
+	defer rs.publishStatus()
+	for {
+		err := rs.recoverLogBatch(rs.currentVersion+1, 0)
+		if err == errDoesNotExist {
+			snapshotVersion, err := rs.Archive().LatestSnapshotVersion()
+			if err == errDoesNotExist || (err == nil && snapshotVersion <= rs.currentVersion) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = rs.recoverLatestSnapshot()
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		atomic.StoreUint64(&rs.lastFlush, rs.currentVersion)
+	}
+}
+
+// checkLease returns ErrNotLeader if the service is run by a Node and
+// another node has acquired the lease, so that a leader that was paused
+// for longer than its lease doesn't write log records after the new
+// leader has started. The caller must hold rs.lock.
+func (rs *RiggedService) checkLease() error {
+	if rs.leaseHolder == "" {
+		return nil
+	}
+	current, err := readLease(rs.objectStore, rs.prefix)
+	if err != nil {
+		return err
+	}
+	if current.Holder != rs.leaseHolder || current.Epoch != rs.epoch {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+// writable returns ErrNotLeader if the service is a follower, or a
+// leader whose lease may have expired because its Node couldn't renew
+// it in time. The caller must hold rs.lock.
+func (rs *RiggedService) writable() error {
+	if rs.role != Leader {
+		return ErrNotLeader
+	}
+	if !rs.leaseDeadline.IsZero() && time.Now().After(rs.leaseDeadline) {
+		return ErrNotLeader
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package rig
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type roleChange struct {
+	role  Role
+	epoch uint64
+}
+
+func TestNodeFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	changes := map[string][]roleChange{}
+	startNode := func(id string) (*Node, *RiggedService, context.CancelFunc) {
+		rs, err := NewRiggedService(&testService{}, NewFileObjectStore(dir), "svc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.testSleep = true
+		n := NewNode(rs, NodeConfig{
+			ID:            id,
+			LeaseDuration: 300 * time.Millisecond,
+			RenewInterval: 50 * time.Millisecond,
+			ClockSkew:     20 * time.Millisecond,
+			PollInterval:  20 * time.Millisecond,
+			OnRoleChange: func(role Role, epoch uint64) {
+				lock.Lock()
+				changes[id] = append(changes[id], roleChange{role, epoch})
+				lock.Unlock()
+			},
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		go n.Run(ctx)
+		return n, rs, cancel
+	}
+	isLeader := func(n *Node, epoch uint64) func() bool {
+		return func() bool {
+			role, e := n.Role()
+			return role == Leader && e == epoch
+		}
+	}
+	hasVersion := func(rs *RiggedService, version uint64) func() bool {
+		return func() bool { return rs.Status().CurrentVersion == version }
+	}
+	op := Operation{Method: "set", Data: []byte("abc")}
+
+	a, rsA, cancelA := startNode("a")
+	defer cancelA()
+	waitFor(t, "a to become the leader", isLeader(a, 1))
+	b, rsB, cancelB := startNode("b")
+	defer cancelB()
+	for i := 0; i < 3; i++ {
+		if err = rsA.Apply(op, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = rsA.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to follow the log", hasVersion(rsB, 3))
+	if err = rsB.Apply(op, false); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader from a follower, got %v", err)
+	}
+
+	// b didn't read the last log record, as if a ReplicaClient
+	// had applied it, so it doesn't know the chain head.
+	rsB.lock.Lock()
+	rsB.chainHead = nil
+	rsB.lock.Unlock()
+
+	// a hands the lease over to b.
+	if err = a.StepDown(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to become the leader", isLeader(b, 2))
+	if err = rsA.Apply(op, false); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader after stepping down, got %v", err)
+	}
+	if err = rsB.Apply(op, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rsB.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to follow the log", hasVersion(rsA, 4))
+	report, err := rsB.Archive().VerifyChain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.LastVersion != 4 {
+		t.Fatalf("expected the new leader to continue the chain, got %+v", report)
+	}
+
+	// b stops renewing its lease, so a takes over once it expires.
+	cancelB()
+	waitFor(t, "a to become the leader again", isLeader(a, 3))
+	// b still has the role of the leader, but its lease expired.
+	if err = rsB.Apply(op, false); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader after the lease expired, got %v", err)
+	}
+	if status := rsA.Status(); status.Role != Leader || status.Epoch != 3 || status.CurrentVersion != 4 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []roleChange{{Leader, 1}, {Follower, 1}, {Leader, 3}}
+	if !reflect.DeepEqual(changes["a"], expected) {
+		t.Fatalf("expected role changes %v for a, got %v", expected, changes["a"])
+	}
+	if !reflect.DeepEqual(changes["b"], []roleChange{{Leader, 2}}) {
+		t.Fatalf("unexpected role changes for b: %v", changes["b"])
+	}
+}
+
+func TestNodeFencing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileObjectStore(dir)
+	rs, err := NewRiggedService(&testService{}, store, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	n := NewNode(rs, NodeConfig{ID: "a"})
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if role, epoch := n.Role(); role != Leader || epoch != 1 {
+		t.Fatalf("expected a to be the leader in epoch 1, got %v in epoch %d", role, epoch)
+	}
+	if err = rs.Apply(Operation{Method: "set", Data: []byte("abc")}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node takes the lease while a isn't renewing it,
+	// and a's lease only changes if it hasn't since it was read.
+	conditional := store.(ConditionalWriter)
+	r, etag, err := conditional.GetObjectETag(leaseObjectName("svc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	taken := []byte(`{"holder":"b","epoch":2,"expires":1}`)
+	if err = conditional.PutObjectIfMatch(leaseObjectName("svc"), bytes.NewReader(taken), int64(len(taken)), etag); err != nil {
+		t.Fatal(err)
+	}
+	if err = conditional.PutObjectIfMatch(leaseObjectName("svc"), bytes.NewReader(taken), int64(len(taken)), etag); err != ErrPreconditionFailed {
+		t.Fatalf("expected ErrPreconditionFailed, got %v", err)
+	}
+	if err = conditional.PutObjectIfMatch(leaseObjectName("svc"), bytes.NewReader(taken), int64(len(taken)), ""); err != ErrPreconditionFailed {
+		t.Fatalf("expected ErrPreconditionFailed creating an object that exists, got %v", err)
+	}
+
+	// a still has time left on its lease,
+	// but it doesn't write a log record.
+	if _, err = rs.Flush(); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader, got %v", err)
+	}
+	if versions := logRecordVersions(t, dir); len(versions) != 0 {
+		t.Fatalf("expected no log records, got %v", versions)
+	}
+	n.lastRenew = time.Time{}
+	if _, err = n.tick(); err != ErrLeaseLost {
+		t.Fatalf("expected ErrLeaseLost renewing the lease, got %v", err)
+	}
+}
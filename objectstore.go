@@ -2,18 +2,31 @@ package rig
 
 import (
 	"bytes"
+	"crypto/md5"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 var errDoesNotExist = errors.New("rig: (internal) does not exist")
 
+var (
+	// ErrPreconditionFailed is returned by PutObjectIfMatch when
+	// the object changed since it was read.
+	ErrPreconditionFailed = errors.New("rig: object changed since it was read")
+	// ErrConditionalUnsupported is returned by PutObjectIfMatch and
+	// GetObjectETag when the backing store doesn't support them.
+	ErrConditionalUnsupported = errors.New("rig: object store does not support conditional writes")
+)
+
 type ObjectStore interface {
 	GetObject(name string) (io.ReadCloser, error)
 	DeleteObject(name string) error
@@ -24,6 +37,51 @@ type DirectoryCreator interface {
 	CreateDirectory(string) error
 }
 
+// Lister is implemented by object stores that can list the
+// objects directly under a directory. Services that recover their
+// own state and nodes that take over from a ReplicaClient need it
+// to continue the log's chain of hashes.
+type Lister interface {
+	ListObjects(dir string) ([]string, error)
+}
+
+// ObjectInfo describes a stored object. ETag is empty
+// if the store doesn't provide one.
+type ObjectInfo struct {
+	Size int64
+	ETag string
+}
+
+// Stater is implemented by object stores that can describe
+// an object without reading it.
+type Stater interface {
+	StatObject(name string) (ObjectInfo, error)
+}
+
+// ConditionalWriter is implemented by object stores that can write an
+// object only if it hasn't changed since it was read, like with HTTP
+// If-Match and If-None-Match. Nodes use it to write the lease.
+type ConditionalWriter interface {
+	// GetObjectETag returns an object and its ETag.
+	GetObjectETag(name string) (io.ReadCloser, string, error)
+	// PutObjectIfMatch writes an object if its ETag is etag, or if it
+	// doesn't exist and etag is empty. It returns ErrPreconditionFailed
+	// otherwise.
+	PutObjectIfMatch(name string, data io.ReadSeeker, size int64, etag string) error
+}
+
+// RecoveryPreparer is implemented by object stores that need
+// to prepare before a RiggedService recovers from a prefix.
+type RecoveryPreparer interface {
+	PrepareRecovery(prefix string) error
+}
+
+// IsNotExist returns a boolean indicating whether the error is
+// known to report that an object does not exist.
+func IsNotExist(err error) bool {
+	return err == errDoesNotExist
+}
+
 func NewS3ObjectStore(s3 *s3.S3, bucket string) ObjectStore {
 	return &s3ObjectStore{
 		s3:     s3,
@@ -59,6 +117,59 @@ func (objectStore *s3ObjectStore) GetObject(name string) (io.ReadCloser, error)
 	return output.Body, nil
 }
 
+func (objectStore *s3ObjectStore) StatObject(name string) (ObjectInfo, error) {
+	input := &s3.HeadObjectInput{}
+	input = input.SetBucket(objectStore.bucket).SetKey(name)
+	output, err := objectStore.s3.HeadObject(input)
+	if err != nil {
+		// HEAD responses don't have a body, so a missing
+		// object is reported as NotFound instead of NoSuchKey.
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+			return ObjectInfo{}, errDoesNotExist
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Size: aws.Int64Value(output.ContentLength),
+		ETag: aws.StringValue(output.ETag),
+	}, nil
+}
+
+func (objectStore *s3ObjectStore) GetObjectETag(name string) (io.ReadCloser, string, error) {
+	input := &s3.GetObjectInput{}
+	input = input.SetBucket(objectStore.bucket).SetKey(name)
+	output, err := objectStore.s3.GetObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", errDoesNotExist
+		}
+		return nil, "", err
+	}
+	return output.Body, aws.StringValue(output.ETag), nil
+}
+
+// PutObjectIfMatch sends If-Match or If-None-Match with PutObject. S3
+// supports them, but some S3-compatible stores ignore them, and then
+// the write isn't conditional.
+func (objectStore *s3ObjectStore) PutObjectIfMatch(name string, data io.ReadSeeker, size int64, etag string) error {
+	input := &s3.PutObjectInput{}
+	input = input.SetBucket(objectStore.bucket).SetKey(name).SetContentLength(size).SetBody(data)
+	req, _ := objectStore.s3.PutObjectRequest(input)
+	if etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	}
+	err := req.Send()
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrPreconditionFailed
+		}
+	}
+	return err
+}
+
 func (objectStore *s3ObjectStore) DeleteObject(name string) error {
 	input := &s3.DeleteObjectInput{}
 	input = input.SetBucket(objectStore.bucket).SetKey(name)
@@ -73,10 +184,30 @@ func (objectStore *s3ObjectStore) PutObject(name string, data io.ReadSeeker, siz
 	return err
 }
 
+func (objectStore *s3ObjectStore) ListObjects(dir string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{}
+	input = input.SetBucket(objectStore.bucket).SetPrefix(dir + "/").SetDelimiter("/")
+	names := []string{}
+	err := objectStore.s3.ListObjectsV2Pages(input, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			names = append(names, *object.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
 type fileObjectStore struct {
 	basePath string
 }
 
+// fileConditionalLock makes conditional writes to file object stores
+// atomic. They are only conditional within a process.
+var fileConditionalLock sync.Mutex
+
 type nopCloser struct {
 	io.Reader
 }
@@ -104,6 +235,62 @@ func (objectStore fileObjectStore) PutObject(name string, data io.ReadSeeker, si
 	return ioutil.WriteFile(filepath.Join(objectStore.basePath, name), buf, 0666)
 }
 
+// GetObjectETag returns an object with the MD5 of its contents as the ETag.
+func (objectStore fileObjectStore) GetObjectETag(name string) (io.ReadCloser, string, error) {
+	res, err := ioutil.ReadFile(filepath.Join(objectStore.basePath, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", errDoesNotExist
+		}
+		return nil, "", err
+	}
+	return nopCloser{bytes.NewReader(res)}, fmt.Sprintf("%x", md5.Sum(res)), nil
+}
+
+func (objectStore fileObjectStore) PutObjectIfMatch(name string, data io.ReadSeeker, size int64, etag string) error {
+	fileConditionalLock.Lock()
+	defer fileConditionalLock.Unlock()
+	r, current, err := objectStore.GetObjectETag(name)
+	if err == nil {
+		r.Close()
+	} else if err != errDoesNotExist {
+		return err
+	}
+	if current != etag {
+		return ErrPreconditionFailed
+	}
+	return objectStore.PutObject(name, data, size)
+}
+
 func (objectStore fileObjectStore) DeleteObject(name string) error {
 	return os.Remove(filepath.Join(objectStore.basePath, name))
 }
+
+func (objectStore fileObjectStore) StatObject(name string) (ObjectInfo, error) {
+	info, err := os.Stat(filepath.Join(objectStore.basePath, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ObjectInfo{}, errDoesNotExist
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: info.Size()}, nil
+}
+
+func (objectStore fileObjectStore) ListObjects(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(objectStore.basePath, dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		names = append(names, filepath.Join(dir, info.Name()))
+	}
+	return names, nil
+}
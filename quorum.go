@@ -0,0 +1,283 @@
+package rig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// QuorumError is returned by QuorumObjectStore when fewer
+// stores than required acknowledge a write.
+type QuorumError struct {
+	Acks     int
+	Required int
+	// Errs are the errors returned by the stores that failed.
+	Errs []error
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("rig: %d of %d required stores acknowledged the write: %v", e.Acks, e.Required, e.Errs[0])
+}
+
+// QuorumObjectStore replicates objects to several object stores. Writes
+// go to every store and succeed once W of them acknowledge. Reads go to
+// the first healthy store, falling back to the others, and write objects
+// that were found back to the stores that were missing them.
+//
+// An object is reported as missing if enough stores report that it
+// doesn't exist that it can't have been written to W of them. Otherwise,
+// the error from the first store that failed is returned.
+//
+// Before a RiggedService recovers, the store with the longest contiguous
+// log is moved to the front, so that recovery reads its LATEST object and
+// log records.
+type QuorumObjectStore struct {
+	stores []ObjectStore
+	w      int
+
+	lock      sync.Mutex
+	primary   int
+	unhealthy []bool
+}
+
+var (
+	_ ObjectStore      = &QuorumObjectStore{}
+	_ RecoveryPreparer = &QuorumObjectStore{}
+)
+
+// NewQuorumObjectStore returns a store that replicates objects
+// to stores and requires w of them to acknowledge writes.
+func NewQuorumObjectStore(stores []ObjectStore, w int) (*QuorumObjectStore, error) {
+	if len(stores) == 0 {
+		return nil, errors.New("rig: no object stores")
+	}
+	if w < 1 || w > len(stores) {
+		return nil, fmt.Errorf("rig: invalid write quorum %d for %d stores", w, len(stores))
+	}
+	return &QuorumObjectStore{
+		stores:    stores,
+		w:         w,
+		unhealthy: make([]bool, len(stores)),
+	}, nil
+}
+
+// readOrder returns the indexes of the stores in the order they are read
+// from: the primary, then healthy stores, then unhealthy stores.
+func (q *QuorumObjectStore) readOrder() []int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	order := []int{q.primary}
+	for _, healthy := range []bool{true, false} {
+		for i := range q.stores {
+			if i != q.primary && q.unhealthy[i] != healthy {
+				order = append(order, i)
+			}
+		}
+	}
+	return order
+}
+
+func (q *QuorumObjectStore) setHealthy(i int, healthy bool) {
+	q.lock.Lock()
+	q.unhealthy[i] = !healthy
+	q.lock.Unlock()
+}
+
+func (q *QuorumObjectStore) GetObject(name string) (io.ReadCloser, error) {
+	missing := []int{}
+	var firstErr error
+	for _, i := range q.readOrder() {
+		r, err := q.stores[i].GetObject(name)
+		if err == nil && len(missing) > 0 {
+			r, err = q.repair(name, r, missing)
+		}
+		if err == nil {
+			q.setHealthy(i, true)
+			return r, nil
+		}
+		if err == errDoesNotExist {
+			q.setHealthy(i, true)
+			missing = append(missing, i)
+			continue
+		}
+		q.setHealthy(i, false)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(missing) > len(q.stores)-q.w {
+		return nil, errDoesNotExist
+	}
+	return nil, firstErr
+}
+
+// repair reads an object and writes it to the stores that were missing
+// it. Failing to write it doesn't fail the read.
+func (q *QuorumObjectStore) repair(name string, r io.ReadCloser, missing []int) (io.ReadCloser, error) {
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range missing {
+		q.stores[i].PutObject(name, bytes.NewReader(b), int64(len(b)))
+	}
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+func (q *QuorumObjectStore) PutObject(name string, data io.ReadSeeker, size int64) error {
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	return q.quorum(func(store ObjectStore) error {
+		return store.PutObject(name, bytes.NewReader(b), int64(len(b)))
+	})
+}
+
+func (q *QuorumObjectStore) DeleteObject(name string) error {
+	return q.quorum(func(store ObjectStore) error {
+		err := store.DeleteObject(name)
+		if err == errDoesNotExist {
+			return nil
+		}
+		return err
+	})
+}
+
+// CreateDirectory creates a directory in the stores
+// that implement DirectoryCreator.
+func (q *QuorumObjectStore) CreateDirectory(path string) error {
+	return q.quorum(func(store ObjectStore) error {
+		if creator, ok := store.(DirectoryCreator); ok {
+			return creator.CreateDirectory(path)
+		}
+		return nil
+	})
+}
+
+// quorum calls fn for every store concurrently, and returns once W
+// calls succeed or too many fail for that to happen. The other calls
+// continue in the background.
+func (q *QuorumObjectStore) quorum(fn func(store ObjectStore) error) error {
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result, len(q.stores))
+	for i, store := range q.stores {
+		go func(i int, store ObjectStore) {
+			err := fn(store)
+			q.setHealthy(i, err == nil)
+			results <- result{i: i, err: err}
+		}(i, store)
+	}
+	acks := 0
+	errs := []error{}
+	for range q.stores {
+		res := <-results
+		if res.err == nil {
+			acks++
+			if acks == q.w {
+				return nil
+			}
+			continue
+		}
+		errs = append(errs, res.err)
+		if len(errs) > len(q.stores)-q.w {
+			break
+		}
+	}
+	return &QuorumError{Acks: acks, Required: q.w, Errs: errs}
+}
+
+// ListObjects returns the objects listed by any of the stores
+// that implement Lister.
+func (q *QuorumObjectStore) ListObjects(dir string) ([]string, error) {
+	listed := map[string]struct{}{}
+	listers := 0
+	var firstErr error
+	for i, store := range q.stores {
+		lister, ok := store.(Lister)
+		if !ok {
+			continue
+		}
+		listers++
+		names, err := lister.ListObjects(dir)
+		if err != nil {
+			q.setHealthy(i, false)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, name := range names {
+			listed[name] = struct{}{}
+		}
+	}
+	if listers == 0 {
+		return nil, ErrListUnsupported
+	}
+	if len(listed) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	names := make([]string, 0, len(listed))
+	for name := range listed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// PrepareRecovery makes the store with the longest contiguous log
+// under prefix the first one read from. Every log record after the
+// latest snapshot of each store is read to find where its log ends.
+func (q *QuorumObjectStore) PrepareRecovery(prefix string) error {
+	best := -1
+	var bestVersion uint64
+	var firstErr error
+	for i, store := range q.stores {
+		version, err := contiguousVersion(NewArchive(store, prefix))
+		if err != nil {
+			q.setHealthy(i, false)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		q.setHealthy(i, true)
+		if best < 0 || version > bestVersion {
+			best, bestVersion = i, version
+		}
+	}
+	if best < 0 {
+		return firstErr
+	}
+	q.lock.Lock()
+	q.primary = best
+	q.lock.Unlock()
+	return nil
+}
+
+// contiguousVersion returns the last version that can be
+// recovered from an archive without gaps.
+func contiguousVersion(archive *Archive) (uint64, error) {
+	version, err := archive.LatestSnapshotVersion()
+	if err != nil && err != errDoesNotExist {
+		return 0, err
+	}
+	for {
+		ops, err := archive.ReadLogBatch(version + 1)
+		if err == errDoesNotExist || (err == nil && len(ops) == 0) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version += uint64(len(ops))
+	}
+}
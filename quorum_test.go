@@ -0,0 +1,154 @@
+package rig
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errUnavailable = errors.New("unavailable")
+
+// unavailableObjectStore fails every request.
+type unavailableObjectStore struct{}
+
+func (unavailableObjectStore) GetObject(name string) (io.ReadCloser, error) {
+	return nil, errUnavailable
+}
+
+func (unavailableObjectStore) PutObject(name string, data io.ReadSeeker, size int64) error {
+	return errUnavailable
+}
+
+func (unavailableObjectStore) DeleteObject(name string) error {
+	return errUnavailable
+}
+
+func TestQuorumObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := NewFileObjectStore(filepath.Join(dir, "a"))
+	b := NewFileObjectStore(filepath.Join(dir, "b"))
+	faulty := &faultyObjectStore{ObjectStore: b, puts: map[string]int{}}
+	q, err := NewQuorumObjectStore([]ObjectStore{a, faulty, unavailableObjectStore{}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = createDirectories(b, "svc"); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := NewRiggedService(&testService{}, q, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	op := Operation{Method: "set", Data: []byte("abc")}
+	rs.Apply(op, false)
+	rs.Apply(op, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	log1 := logRecordName("svc", 1)
+	for _, store := range []ObjectStore{a, b} {
+		readObject(t, store, log1)
+	}
+
+	// Objects missing from a store are repaired when they're read.
+	if err = a.DeleteObject(log1); err != nil {
+		t.Fatal(err)
+	}
+	readObject(t, q, log1)
+	readObject(t, a, log1)
+
+	// Missing objects are only reported as missing
+	// if a quorum of stores report them as missing.
+	if _, err = q.GetObject(logRecordName("svc", 3)); !IsNotExist(err) {
+		t.Fatalf("expected a missing object, got %v", err)
+	}
+	faulty.setFail(func(string) error { return errUnavailable })
+	rs.Apply(op, false)
+	_, err = rs.Flush()
+	if qerr, ok := err.(*QuorumError); !ok || qerr.Required != 2 || len(qerr.Errs) != 2 {
+		t.Fatalf("expected a quorum error with 2 failures, got %v", err)
+	}
+	// With two stores unavailable, an object missing from
+	// the third could still have been written to them.
+	if err = a.DeleteObject(log1); err != nil {
+		t.Fatal(err)
+	}
+	q2, err := NewQuorumObjectStore([]ObjectStore{a, unavailableObjectStore{}, unavailableObjectStore{}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q2.GetObject(log1); err != errUnavailable {
+		t.Fatalf("expected the store's error, got %v", err)
+	}
+}
+
+func TestQuorumRecoverLongestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := NewFileObjectStore(filepath.Join(dir, "a"))
+	b := NewFileObjectStore(filepath.Join(dir, "b"))
+	faulty := &faultyObjectStore{ObjectStore: b, puts: map[string]int{}}
+	if err = createDirectories(b, "svc"); err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQuorumObjectStore([]ObjectStore{a, faulty}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := NewRiggedService(&testService{}, q, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	op := Operation{Method: "set", Data: []byte("abc")}
+	rs.Apply(op, false)
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// b misses the last snapshot and log record.
+	faulty.setFail(func(string) error { return errUnavailable })
+	rs.Apply(op, false)
+	rs.Apply(op, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(op, false)
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = NewQuorumObjectStore([]ObjectStore{b, a}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err = NewRiggedService(&testService{}, q, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if version := rs.Status().CurrentVersion; version != 4 {
+		t.Fatalf("expected to recover version 4, got %d", version)
+	}
+	if q.primary != 1 {
+		t.Fatalf("expected the store with the longest log to be read first, got %d", q.primary)
+	}
+}
@@ -0,0 +1,44 @@
+package rig
+
+import (
+	"context"
+)
+
+// Viewer is implemented by services that keep multiple versions of
+// their state, so they can be read without blocking Apply.
+type Viewer interface {
+	// RetainView keeps the state at version, which is the current
+	// version, readable until release is called, even if operations
+	// are applied. How it's read depends on the service.
+	RetainView(version uint64) (release func())
+}
+
+// Read calls fn with the version of the service's state, which doesn't
+// change until fn returns. If the service implements Viewer, that
+// version is retained while fn runs and operations can be applied
+// concurrently. Otherwise fn runs while operations are excluded, and it
+// must not call methods of rs.
+func (rs *RiggedService) Read(fn func(version uint64) error) error {
+	rs.lock.Lock()
+	version := rs.currentVersion
+	viewer, ok := rs.service.(Viewer)
+	if !ok {
+		defer rs.lock.Unlock()
+		return fn(version)
+	}
+	release := viewer.RetainView(version)
+	rs.lock.Unlock()
+	defer release()
+	return fn(version)
+}
+
+// ReadAtLeast waits until the service has applied a version, or the
+// context is done, and then calls Read. Use the version returned by
+// ApplyBatch to read your own writes, including on a follower.
+func (rs *RiggedService) ReadAtLeast(ctx context.Context, version uint64, fn func(version uint64) error) error {
+	err := rs.waitForVersion(ctx, version)
+	if err != nil {
+		return err
+	}
+	return rs.Read(fn)
+}
@@ -0,0 +1,59 @@
+package rig
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRead(t *testing.T) {
+	rs, cleanup := newTestRiggedService(t)
+	defer cleanup()
+	op := Operation{Method: "set", Data: []byte("abc")}
+	rs.Apply(op, false)
+
+	// Operations aren't applied while reading.
+	applied := make(chan struct{})
+	err := rs.Read(func(version uint64) error {
+		if version != 1 {
+			t.Fatalf("expected to read version 1, got %d", version)
+		}
+		go func() {
+			rs.Apply(op, false)
+			close(applied)
+		}()
+		select {
+		case <-applied:
+			t.Fatal("applied an operation while reading")
+		case <-time.After(20 * time.Millisecond):
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-applied
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		rs.Apply(op, false)
+	}()
+	err = rs.ReadAtLeast(context.Background(), 3, func(version uint64) error {
+		if version < 3 {
+			t.Fatalf("expected to read at least version 3, got %d", version)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = rs.ReadAtLeast(ctx, 10, func(uint64) error {
+		t.Fatal("read a version that wasn't applied")
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
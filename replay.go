@@ -0,0 +1,263 @@
+package rig
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ServiceFactory creates a new Service with empty state.
+type ServiceFactory func() (Service, error)
+
+var (
+	servicesLock sync.Mutex
+	services     = map[string]ServiceFactory{}
+)
+
+// RegisterService makes a service available by name to tools like
+// rigctl. It is meant to be called from an init function and panics
+// if a service is registered twice.
+func RegisterService(name string, factory ServiceFactory) {
+	servicesLock.Lock()
+	defer servicesLock.Unlock()
+	if factory == nil {
+		panic("rig: RegisterService factory is nil")
+	}
+	if _, dup := services[name]; dup {
+		panic("rig: RegisterService called twice for " + name)
+	}
+	services[name] = factory
+}
+
+// NewService creates a service using a registered factory.
+func NewService(name string) (Service, error) {
+	servicesLock.Lock()
+	factory, ok := services[name]
+	servicesLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("rig: unknown service %q", name)
+	}
+	return factory()
+}
+
+// Services returns the sorted names of the registered services.
+func Services() []string {
+	servicesLock.Lock()
+	defer servicesLock.Unlock()
+	names := []string{}
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReplayConfig configures Replay.
+type ReplayConfig struct {
+	Source            ObjectStore
+	SourcePrefix      string
+	Destination       ObjectStore
+	DestinationPrefix string
+
+	// Service receives the replayed operations. It should be empty.
+	Service Service
+
+	// Upcasters, if set, are applied to operations before they
+	// are passed to Service.
+	Upcasters *Upcasters
+
+	// FromSnapshot restores Service from the latest source snapshot
+	// instead of replaying the log from the first version. Use it when
+	// older log records have been deleted and the service can read
+	// the source snapshot format.
+	FromSnapshot bool
+
+	// RewriteLogs writes the replayed log records to the destination,
+	// with upcasted operations.
+	RewriteLogs bool
+
+	// CheckpointInterval is the minimum number of operations between
+	// snapshots written to the destination. Replay resumes from the
+	// latest destination snapshot, so checkpoints bound the work lost
+	// when a replay is interrupted. Zero only snapshots at the end.
+	CheckpointInterval uint64
+
+	// Progress, if set, is called after every replayed log record.
+	Progress func(ReplayProgress)
+}
+
+// ReplayProgress describes how far a replay has progressed.
+type ReplayProgress struct {
+	// Version is the last replayed version.
+	Version uint64
+	// LastVersion is the last version in the source log.
+	LastVersion uint64
+	// Checkpoint is the version of the last destination snapshot.
+	Checkpoint uint64
+}
+
+// Replay rebuilds the state of a rigged service by feeding the snapshots
+// and log records under one prefix through config.Service, and writes a
+// fresh snapshot to another prefix. If the destination already has a
+// snapshot, Replay restores it and resumes from its version.
+// It returns the last replayed version.
+func Replay(config ReplayConfig) (uint64, error) {
+	source := NewArchive(config.Source, config.SourcePrefix)
+	destination := NewArchive(config.Destination, config.DestinationPrefix)
+	err := createDirectories(config.Destination, config.DestinationPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var version uint64
+	// chainHead is the hash of the last log record
+	// rewritten to the destination.
+	var chainHead []byte
+	checkpointed := false
+	checkpoint, err := destination.LatestSnapshotVersion()
+	switch {
+	case err == nil:
+		err = restoreSnapshot(destination, config.Service, checkpoint)
+		if err != nil {
+			return 0, err
+		}
+		manifest, err := destination.snapshotManifest(checkpoint)
+		if err != nil && !IsNotExist(err) {
+			return 0, err
+		}
+		chainHead = manifest.ChainHead
+		version = checkpoint
+		checkpointed = true
+	case !IsNotExist(err):
+		return 0, err
+	case config.FromSnapshot:
+		version, err = source.LatestSnapshotVersion()
+		if err != nil {
+			return 0, err
+		}
+		err = restoreSnapshot(source, config.Service, version)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Count checkpoint intervals from where the replay starts.
+	checkpointBase := version
+
+	records, err := source.LogRecords()
+	if err != nil {
+		return 0, err
+	}
+	namesByVersion := map[uint64][]string{}
+	for _, record := range records {
+		namesByVersion[record.Version] = append(namesByVersion[record.Version], record.Name)
+	}
+	// lastVersion is an estimate until the last record is read.
+	var lastRecordVersion, lastVersion uint64
+	if len(records) > 0 {
+		lastRecordVersion = records[len(records)-1].Version
+		lastVersion = lastRecordVersion
+	}
+
+	for {
+		names, ok := namesByVersion[version+1]
+		if !ok {
+			if version < lastRecordVersion {
+				return version, fmt.Errorf("rig: missing log record for version %d", version+1)
+			}
+			break
+		}
+		batchVersion := version + 1
+		ops, err := readFirstLogRecord(source, names)
+		if err != nil {
+			return version, err
+		}
+		if len(ops) == 0 {
+			return version, fmt.Errorf("rig: empty log record for version %d", batchVersion)
+		}
+		for i, op := range ops {
+			op, err = config.Upcasters.Upcast(op)
+			if err != nil {
+				return version, err
+			}
+			err = applyOperation(config.Service, version+1, op)
+			if err != nil {
+				return version, err
+			}
+			ops[i] = op
+			version++
+		}
+		if config.RewriteLogs {
+			batchDigest, err := digest(config.Service)
+			if err != nil {
+				return version, err
+			}
+			buf, err := encodeLogBatch(logBatch{
+				Version:    batchVersion,
+				Operations: ops,
+				Digest:     batchDigest,
+				Previous:   chainHead,
+			})
+			if err != nil {
+				return version, err
+			}
+			err = config.Destination.PutObject(logRecordName(config.DestinationPrefix, batchVersion),
+				bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				return version, err
+			}
+			chainHead = hashLogRecord(buf.Bytes())
+		}
+		if version > lastVersion {
+			lastVersion = version
+		}
+		if config.CheckpointInterval > 0 && version-checkpointBase >= config.CheckpointInterval {
+			_, err = putSnapshot(config.Destination, config.DestinationPrefix, config.Service,
+				snapshotManifest{Version: version, ChainHead: chainHead})
+			if err != nil {
+				return version, err
+			}
+			checkpoint, checkpointBase, checkpointed = version, version, true
+		}
+		if config.Progress != nil {
+			config.Progress(ReplayProgress{
+				Version:     version,
+				LastVersion: lastVersion,
+				Checkpoint:  checkpoint,
+			})
+		}
+	}
+
+	if !checkpointed || version != checkpoint {
+		_, err = putSnapshot(config.Destination, config.DestinationPrefix, config.Service,
+			snapshotManifest{Version: version, ChainHead: chainHead})
+		if err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+func restoreSnapshot(archive *Archive, service Service, version uint64) error {
+	r, err := archive.OpenSnapshot(version)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return service.Restore(version, r)
+}
+
+// readFirstLogRecord returns the operations in the first
+// of the named log records that can be read.
+func readFirstLogRecord(archive *Archive, names []string) ([]Operation, error) {
+	var err error
+	for _, name := range names {
+		var ops []Operation
+		ops, err = archive.ReadLogRecord(name)
+		if err == nil {
+			return ops, nil
+		}
+	}
+	return nil, err
+}
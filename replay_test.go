@@ -0,0 +1,95 @@
+package rig
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectStore := NewFileObjectStore(dir)
+
+	rs, err := NewRiggedService(&testService{}, objectStore, "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		rs.Apply(Operation{}, false)
+		rs.Apply(Operation{}, false)
+		if _, err = rs.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	progress := []ReplayProgress{}
+	config := ReplayConfig{
+		Source:             objectStore,
+		SourcePrefix:       "src",
+		Destination:        objectStore,
+		DestinationPrefix:  "dst",
+		Service:            &testService{},
+		RewriteLogs:        true,
+		CheckpointInterval: 3,
+		Progress:           func(p ReplayProgress) { progress = append(progress, p) },
+	}
+	version, err := Replay(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 6 {
+		t.Fatalf("expected version 6, got %d", version)
+	}
+	if len(progress) != 3 || progress[1].Checkpoint != 4 || progress[2].LastVersion != 6 {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+
+	destination := NewArchive(objectStore, "dst")
+	latest, err := destination.LatestSnapshotVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != 6 {
+		t.Fatalf("expected destination snapshot 6, got %d", latest)
+	}
+	report, err := destination.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Batches != 0 {
+		t.Fatalf("unexpected destination report %+v", report)
+	}
+	if _, err = destination.ReadLogBatch(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying again resumes from the destination snapshot.
+	progress = progress[:0]
+	service := &testService{}
+	config.Service = service
+	version, err = Replay(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 6 || service.version != 6 || len(progress) != 0 {
+		t.Fatalf("unexpected resumed replay: version %d, service %d, progress %+v", version, service.version, progress)
+	}
+}
+
+func TestRegisterService(t *testing.T) {
+	RegisterService("rig-test", func() (Service, error) { return &testService{version: 3}, nil })
+	service, err := NewService("rig-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := service.Version(); version != 3 {
+		t.Fatalf("unexpected service version %d", version)
+	}
+	if _, err = NewService("rig-missing"); err == nil {
+		t.Fatal("expected an error for an unknown service")
+	}
+}
@@ -0,0 +1,528 @@
+package rig
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReplicationBufferSize is the number of applied changes a
+// ReplicationServer keeps for followers by default.
+const DefaultReplicationBufferSize = 10000
+
+var (
+	// ErrReplicaDiverged is returned by ReplicaClient.Run when operations
+	// streamed from a leader that weren't flushed yet differ from the ones
+	// in the log, which happens if the leader lost them. The service must
+	// be recovered from a new process.
+	ErrReplicaDiverged = errors.New("rig: replicated operations differ from the log")
+
+	errReplicaBehind = errors.New("rig: replica is behind the replication buffer")
+)
+
+// replicationRequest is sent by followers, first with Next
+// and then with Applied as they apply changes.
+type replicationRequest struct {
+	Next    uint64 `json:"next,omitempty"`
+	Applied uint64 `json:"applied,omitempty"`
+}
+
+// replicationMessage is sent by leaders. It has a change, or only
+// the flushed version if that changed, or Behind if the follower has
+// to catch up from the object store. Digest is the digest recorded
+// at the flushed version, if any.
+type replicationMessage struct {
+	Version   uint64     `json:"version,omitempty"`
+	Operation *Operation `json:"op,omitempty"`
+	Flushed   uint64     `json:"flushed"`
+	Digest    []byte     `json:"digest,omitempty"`
+	Behind    bool       `json:"behind,omitempty"`
+}
+
+// ReplicationServer streams the operations applied by a RiggedService
+// to followers over TCP as they are applied, before they are flushed.
+//
+// The protocol is a stream of JSON values in each direction. Followers
+// send the next version they need, and then acknowledge each version
+// they apply. The server sends each change along with the last flushed
+// version. Recent changes are kept in memory, and a follower that needs
+// older changes is told to catch up from the object store instead.
+type ReplicationServer struct {
+	rs         *RiggedService
+	bufferSize int
+
+	lock sync.Mutex
+	// buffer has the changes before next.
+	buffer  []Change
+	next    uint64
+	flushed uint64
+	// digest is the digest recorded at flushed, if any.
+	digest []byte
+	// notify is closed when a change is applied or flushed.
+	notify    chan struct{}
+	followers map[net.Conn]uint64
+	listener  net.Listener
+	closed    bool
+}
+
+// NewReplicationServer returns a server that streams the operations
+// rs applies from now on, keeping up to bufferSize of them. A bufferSize
+// of 0 uses DefaultReplicationBufferSize. Create it after rs recovers.
+func NewReplicationServer(rs *RiggedService, bufferSize int) *ReplicationServer {
+	if bufferSize <= 0 {
+		bufferSize = DefaultReplicationBufferSize
+	}
+	s := &ReplicationServer{
+		rs:         rs,
+		bufferSize: bufferSize,
+		followers:  map[net.Conn]uint64{},
+	}
+	rs.lock.Lock()
+	s.next = rs.currentVersion + 1
+	s.flushed = rs.lastFlush
+	rs.replication = s
+	rs.lock.Unlock()
+	return s
+}
+
+// Serve accepts followers on l until Close is called.
+func (s *ReplicationServer) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return errors.New("rig: replication server closed")
+	}
+	s.listener = l
+	s.lock.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting followers and disconnects them.
+func (s *ReplicationServer) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.signal()
+	for conn := range s.followers {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// Followers returns the last version acknowledged by
+// each connected follower, by remote address.
+func (s *ReplicationServer) Followers() map[string]uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	applied := map[string]uint64{}
+	for conn, version := range s.followers {
+		applied[conn.RemoteAddr().String()] = version
+	}
+	return applied
+}
+
+func (s *ReplicationServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	var hello replicationRequest
+	if err := dec.Decode(&hello); err != nil {
+		return
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.followers[conn] = hello.Next - 1
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.followers, conn)
+		s.lock.Unlock()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var ack replicationRequest
+			if err := dec.Decode(&ack); err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.followers[conn] = ack.Applied
+			s.lock.Unlock()
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	next := hello.Next
+	sentFlushed := uint64(0)
+	for {
+		changes, flushed, digest, notify, ok := s.changesSince(next)
+		if notify == nil {
+			// Closed
+			return
+		}
+		if !ok {
+			enc.Encode(replicationMessage{Flushed: flushed, Behind: true})
+			w.Flush()
+			return
+		}
+		for i := range changes {
+			err := enc.Encode(replicationMessage{
+				Version:   changes[i].Version,
+				Operation: &changes[i].Operation,
+				Flushed:   flushed,
+				Digest:    digest,
+			})
+			if err != nil {
+				return
+			}
+			next = changes[i].Version + 1
+		}
+		if len(changes) == 0 && flushed != sentFlushed {
+			if err := enc.Encode(replicationMessage{Flushed: flushed, Digest: digest}); err != nil {
+				return
+			}
+		}
+		sentFlushed = flushed
+		if err := w.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-notify:
+		case <-done:
+			return
+		}
+	}
+}
+
+// changesSince returns the buffered changes starting at a version, the
+// last flushed version and its digest, and a channel that is closed
+// when they change. It returns false if the changes aren't buffered,
+// and a nil channel if the server is closed.
+func (s *ReplicationServer) changesSince(version uint64) ([]Change, uint64, []byte, chan struct{}, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, 0, nil, nil, false
+	}
+	if s.notify == nil {
+		s.notify = make(chan struct{})
+	}
+	start := s.next - uint64(len(s.buffer))
+	if version < start || version > s.next {
+		return nil, s.flushed, s.digest, s.notify, false
+	}
+	changes := append([]Change(nil), s.buffer[version-start:]...)
+	return changes, s.flushed, s.digest, s.notify, true
+}
+
+// signal wakes up the connections. The caller must hold s.lock.
+func (s *ReplicationServer) signal() {
+	if s.notify != nil {
+		close(s.notify)
+		s.notify = nil
+	}
+}
+
+func (s *ReplicationServer) append(version uint64, ops []Operation) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if version != s.next {
+		// The service was recovered or restored
+		// to a different version.
+		s.buffer = s.buffer[:0]
+	}
+	for _, op := range ops {
+		s.buffer = append(s.buffer, Change{Version: version, Operation: op})
+		version++
+	}
+	if over := len(s.buffer) - s.bufferSize; over > 0 {
+		s.buffer = append(s.buffer[:0], s.buffer[over:]...)
+	}
+	s.next = version
+	s.signal()
+}
+
+func (s *ReplicationServer) setFlushed(version uint64, digest []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flushed = version
+	s.digest = digest
+	s.signal()
+}
+
+// replicate sends applied operations to the replication server.
+// The caller must hold rs.lock.
+func (rs *RiggedService) replicate(version uint64, ops []Operation) {
+	if rs.replication != nil && len(ops) > 0 {
+		rs.replication.append(version, ops)
+	}
+}
+
+// replicateFlushed sends the last flushed version and the digest
+// recorded at it, if any, to the replication server. The caller
+// must hold rs.lock.
+func (rs *RiggedService) replicateFlushed(digest []byte) {
+	if rs.replication != nil {
+		rs.replication.setFlushed(rs.lastFlush, digest)
+	}
+}
+
+// ReplicaClient keeps a RiggedService up to date with a leader by
+// applying the changes streamed by its ReplicationServer. When the
+// connection fails or the client is too far behind, it catches up from
+// the object store. The service becomes a follower.
+//
+// Changes are applied before the leader flushes them, so the client
+// keeps them until the leader reports they are flushed. If it reads
+// different operations from the log for those versions, Run returns
+// ErrReplicaDiverged. If the service is a Digester and its state doesn't
+// match a digest recorded by the leader, Run returns ErrDivergence, and
+// if a log record fails verification, it returns a ChainError.
+type ReplicaClient struct {
+	rs   *RiggedService
+	addr string
+
+	// RetryInterval is how long to wait before reconnecting
+	// after an error. The default is 1 second.
+	RetryInterval time.Duration
+	// OnError, if set, is called with errors that
+	// don't stop Run, like failing to connect.
+	OnError func(error)
+
+	// unconfirmed has the changes after rs.lastFlush
+	// that were applied from the stream.
+	unconfirmed []Change
+}
+
+// NewReplicaClient returns a client that replicates
+// to rs from the ReplicationServer at addr.
+func NewReplicaClient(rs *RiggedService, addr string) *ReplicaClient {
+	rs.lock.Lock()
+	rs.role = Follower
+	rs.publishStatus()
+	rs.lock.Unlock()
+	return &ReplicaClient{
+		rs:            rs,
+		addr:          addr,
+		RetryInterval: time.Second,
+	}
+}
+
+// Run recovers the service and then replicates
+// changes until the context is done.
+func (c *ReplicaClient) Run(ctx context.Context) error {
+	err := c.rs.Recover()
+	if err != nil {
+		return err
+	}
+	for {
+		before := c.rs.Status().CurrentVersion
+		err = c.catchUp()
+		if untrusted(err) || err == ErrReplicaDiverged {
+			return err
+		}
+		if err == nil {
+			err = c.stream(ctx)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == errReplicaBehind && c.rs.Status().CurrentVersion > before {
+			// Reconnect right away since catching up made progress.
+			continue
+		}
+		if err != nil && err != errReplicaBehind && c.OnError != nil {
+			c.OnError(err)
+		}
+		timer := time.NewTimer(c.RetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// stream applies the changes from the leader until the
+// connection fails or the leader reports the client is behind.
+func (c *ReplicaClient) stream(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	c.rs.lock.Lock()
+	next := c.rs.currentVersion + 1
+	c.rs.lock.Unlock()
+	err = enc.Encode(replicationRequest{Next: next})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		var msg replicationMessage
+		err = dec.Decode(&msg)
+		if err != nil {
+			return err
+		}
+		if msg.Behind {
+			return errReplicaBehind
+		}
+		applied, err := c.apply(msg)
+		if err != nil {
+			return err
+		}
+		if applied == 0 {
+			continue
+		}
+		err = enc.Encode(replicationRequest{Applied: applied})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// apply applies a streamed change and returns its version,
+// or 0 if the message doesn't have a change.
+func (c *ReplicaClient) apply(msg replicationMessage) (uint64, error) {
+	rs := c.rs
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	defer rs.publishStatus()
+	applied := uint64(0)
+	if msg.Operation != nil {
+		if msg.Version != rs.currentVersion+1 {
+			return 0, fmt.Errorf("rig: expected version %d from the leader, got %d", rs.currentVersion+1, msg.Version)
+		}
+		op, err := rs.upcasters.Upcast(*msg.Operation)
+		if err != nil {
+			return 0, err
+		}
+		err = rs.applyOperation(msg.Version, op)
+		if err != nil {
+			return 0, err
+		}
+		rs.currentVersion = msg.Version
+		c.unconfirmed = append(c.unconfirmed, Change{Version: msg.Version, Operation: *msg.Operation})
+		applied = msg.Version
+	}
+	flushed := msg.Flushed
+	if flushed > rs.currentVersion {
+		flushed = rs.currentVersion
+	}
+	if flushed > rs.lastFlush {
+		err := rs.checkDigest(msg.Flushed, msg.Digest)
+		if err != nil {
+			return 0, err
+		}
+		// The log records weren't read, so the next
+		// one can't be checked against the chain.
+		rs.chainHead = nil
+		atomic.StoreUint64(&rs.lastFlush, flushed)
+		c.confirm()
+	}
+	return applied, nil
+}
+
+// confirm drops the unconfirmed changes that are flushed.
+// The caller must hold rs.lock.
+func (c *ReplicaClient) confirm() {
+	i := 0
+	for i < len(c.unconfirmed) && c.unconfirmed[i].Version <= c.rs.lastFlush {
+		i++
+	}
+	c.unconfirmed = append(c.unconfirmed[:0], c.unconfirmed[i:]...)
+}
+
+// catchUp applies the log records that were written since the last
+// flushed version, checking the unconfirmed changes against them.
+func (c *ReplicaClient) catchUp() error {
+	rs := c.rs
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for len(c.unconfirmed) > 0 {
+		version := rs.lastFlush + 1
+		batch, hash, err := rs.readLogBatch(logRecordName(rs.prefix, version), version)
+		ops := batch.Operations
+		if err == errDoesNotExist {
+			// Not flushed yet.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, op := range ops {
+			if version+uint64(i) > rs.currentVersion {
+				err = rs.applyLogBatch(version+uint64(i), ops[i:])
+				if err != nil {
+					return err
+				}
+				break
+			}
+			if i < len(c.unconfirmed) && !sameOperation(op, c.unconfirmed[i].Operation) {
+				return ErrReplicaDiverged
+			}
+		}
+		rs.advanceChain(batch, hash)
+		err = rs.checkDigest(version+uint64(len(ops))-1, batch.Digest)
+		if err != nil {
+			return err
+		}
+		atomic.StoreUint64(&rs.lastFlush, version+uint64(len(ops))-1)
+		c.confirm()
+	}
+	return rs.catchUp()
+}
+
+func sameOperation(a, b Operation) bool {
+	return a.Method == b.Method && a.Schema == b.Schema && bytes.Equal(a.Data, b.Data) &&
+		a.Timestamp == b.Timestamp && a.Seed == b.Seed
+}
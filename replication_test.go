@@ -0,0 +1,155 @@
+package rig
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func startReplication(t *testing.T, rs *RiggedService, bufferSize int) (*ReplicationServer, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewReplicationServer(rs, bufferSize)
+	go server.Serve(l)
+	return server, l.Addr().String()
+}
+
+func startReplica(t *testing.T, dir, addr string) (*RiggedService, *recordingService, chan error, context.CancelFunc) {
+	t.Helper()
+	service := &recordingService{}
+	rs, err := NewRiggedService(service, NewFileObjectStore(dir), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	client := NewReplicaClient(rs, addr)
+	client.RetryInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- client.Run(ctx) }()
+	return rs, service, errs, cancel
+}
+
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leader, err := NewRiggedService(&testService{}, NewFileObjectStore(dir), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader.testSleep = true
+	if err = leader.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	server, addr := startReplication(t, leader, 2)
+	defer server.Close()
+	replica, _, errs, cancel := startReplica(t, dir, addr)
+
+	// Changes are streamed before they're flushed.
+	op := Operation{Method: "set", Data: []byte("abc")}
+	leader.Apply(op, false)
+	leader.Apply(op, false)
+	waitFor(t, "the replica to apply the changes", func() bool {
+		return replica.Status().CurrentVersion == 2
+	})
+	waitFor(t, "the replica to acknowledge the changes", func() bool {
+		for _, applied := range server.Followers() {
+			return applied == 2
+		}
+		return false
+	})
+	if status := replica.Status(); status.LastFlush != 0 || status.Role != Follower {
+		t.Fatalf("unexpected replica status %+v", status)
+	}
+	if err = replica.Apply(op, false); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader from a replica, got %v", err)
+	}
+	if _, err = leader.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replica to see the flush", func() bool {
+		return replica.Status().LastFlush == 2
+	})
+
+	// A replica that's further behind than the
+	// buffer catches up from the object store.
+	cancel()
+	<-errs
+	for i := 0; i < 5; i++ {
+		leader.Apply(op, false)
+	}
+	if _, err = leader.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	leader.Apply(op, false)
+	replica, service, errs, cancel := startReplica(t, dir, addr)
+	defer cancel()
+	waitFor(t, "the replica to catch up", func() bool {
+		return replica.Status().CurrentVersion == 8
+	})
+	if len(service.ops) != 8 {
+		t.Fatalf("expected 8 operations to be applied, got %d", len(service.ops))
+	}
+	leader.Apply(op, false)
+	waitFor(t, "the replica to apply the change", func() bool {
+		return replica.Status().CurrentVersion == 9
+	})
+}
+
+func TestReplicaDiverged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leader, err := NewRiggedService(&testService{}, NewFileObjectStore(dir), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader.testSleep = true
+	if err = leader.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	server, addr := startReplication(t, leader, 0)
+	replica, _, errs, cancel := startReplica(t, dir, addr)
+	defer cancel()
+	leader.Apply(Operation{Method: "set", Data: []byte("lost")}, false)
+	waitFor(t, "the replica to apply the change", func() bool {
+		return replica.Status().CurrentVersion == 1
+	})
+
+	// The leader goes away before flushing, and
+	// a new leader writes a different version 1.
+	server.Close()
+	leader, err = NewRiggedService(&testService{}, NewFileObjectStore(dir), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader.testSleep = true
+	if err = leader.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	leader.Apply(Operation{Method: "set", Data: []byte("new")}, false)
+	if _, err = leader.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-errs:
+		if err != ErrReplicaDiverged {
+			t.Fatalf("expected ErrReplicaDiverged, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the replica to diverge")
+	}
+}
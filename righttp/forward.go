@@ -0,0 +1,121 @@
+package righttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/Preetam/rig"
+)
+
+// ForwardedHeader marks requests sent by a Forwarder. The IngressHandler
+// applies them without forwarding them again, and returns 421 if its
+// service isn't the leader.
+const ForwardedHeader = "Rig-Forwarded"
+
+// Forwarder is a rig.Forwarder that sends operations to the
+// IngressHandler of the leader. Leader addresses are the URL
+// the handler is served at, like "http://10.0.0.1:8080/apply".
+// The context's rig.IdempotencyKey is sent as the Idempotency-Key
+// header.
+type Forwarder struct {
+	client *http.Client
+}
+
+var _ rig.Forwarder = &Forwarder{}
+
+// NewForwarder returns a Forwarder that uses client,
+// or http.DefaultClient if it's nil.
+func NewForwarder(client *http.Client) *Forwarder {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Forwarder{
+		client: client,
+	}
+}
+
+func (f *Forwarder) Forward(ctx context.Context, leader string, ops []rig.Operation, waitUntilDurable bool) (uint64, error) {
+	u, err := url.Parse(leader)
+	if err != nil {
+		return 0, err
+	}
+	if waitUntilDurable {
+		query := u.Query()
+		query.Set("durable", "true")
+		u.RawQuery = query.Encode()
+	}
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ForwardedHeader, "true")
+	if key := rig.IdempotencyKey(ctx); key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if dialError(err) {
+			return 0, rig.ErrLeaderUnavailable
+		}
+		return 0, rig.ErrOutcomeUnknown
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		applied := applyResponse{}
+		err = json.NewDecoder(resp.Body).Decode(&applied)
+		if err != nil {
+			return 0, rig.ErrOutcomeUnknown
+		}
+		return applied.Version, nil
+	}
+	errResp := errorResponse{}
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	return errResp.Version, leaderError(resp.StatusCode, errResp)
+}
+
+// dialError returns true if a request failed because connecting to the
+// server failed, like when the connection is refused, so it wasn't sent.
+func dialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// leaderError converts an error response from the leader
+// back to the error its service returned.
+func leaderError(code int, errResp errorResponse) error {
+	message := errResp.Error
+	switch code {
+	case http.StatusBadRequest:
+		validationErr := rig.ValidationError{Err: errors.New(message)}
+		if errResp.Index != nil {
+			validationErr.Index = *errResp.Index
+		}
+		return validationErr
+	case http.StatusMisdirectedRequest:
+		return rig.ErrLeaderUnavailable
+	}
+	for _, err := range []error{rig.ErrBackpressure, rig.ErrRateLimited, rig.ErrTimeout, rig.ErrLeaderUnavailable} {
+		if message == err.Error() {
+			return err
+		}
+	}
+	return fmt.Errorf("righttp: leader returned %d: %s", code, message)
+}
@@ -0,0 +1,79 @@
+package righttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Preetam/rig"
+)
+
+func TestForwarder(t *testing.T) {
+	leader, cleanup := newTestRiggedService(t)
+	defer cleanup()
+	server := httptest.NewServer(NewIngressHandler(leader))
+	defer server.Close()
+	f := NewForwarder(nil)
+	ctx := context.Background()
+
+	op := rig.Operation{Method: "set"}
+	version, err := f.Forward(ctx, server.URL, []rig.Operation{op, op}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected version 2, got %d", version)
+	}
+	version, err = f.Forward(ctx, server.URL, []rig.Operation{op, {Method: "invalid"}}, false)
+	if validationErr, ok := err.(rig.ValidationError); !ok || validationErr.Index != 1 || version != 3 {
+		t.Fatalf("expected a validation error at index 1 after version 3, got %d and %v", version, err)
+	}
+
+	// A follower doesn't forward operations that were already forwarded.
+	follower, cleanup := newTestRiggedService(t)
+	defer cleanup()
+	rig.NewNode(follower, rig.NodeConfig{ID: "follower"})
+	follower.SetForwarding(rig.ForwardConfig{Forwarder: f, Leader: server.URL})
+	followerServer := httptest.NewServer(NewIngressHandler(follower))
+	defer followerServer.Close()
+	if _, err = f.Forward(ctx, followerServer.URL, []rig.Operation{op}, false); err != rig.ErrLeaderUnavailable {
+		t.Fatalf("expected ErrLeaderUnavailable from a follower, got %v", err)
+	}
+	version, err = follower.ApplyBatch(ctx, []rig.Operation{op}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 4 {
+		t.Fatalf("expected version 4, got %d", version)
+	}
+
+	// Retries with the same idempotency key are applied once.
+	keyCtx := rig.WithIdempotencyKey(ctx, "key")
+	for i := 0; i < 2; i++ {
+		version, err = follower.ApplyBatch(keyCtx, []rig.Operation{op}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 5 {
+			t.Fatalf("expected version 5, got %d", version)
+		}
+	}
+
+	server.Close()
+	if _, err = f.Forward(ctx, server.URL, []rig.Operation{op}, false); err != rig.ErrLeaderUnavailable {
+		t.Fatalf("expected ErrLeaderUnavailable from a stopped leader, got %v", err)
+	}
+
+	// A leader that closes the connection may have applied the operations.
+	hangUp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer hangUp.Close()
+	if _, err = f.Forward(ctx, hangUp.URL, []rig.Operation{op}, false); err != rig.ErrOutcomeUnknown {
+		t.Fatalf("expected ErrOutcomeUnknown from a leader that hung up, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+// Package righttp exposes a RiggedService over HTTP.
+package righttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Preetam/rig"
+)
+
+// Handler is an administrative http.Handler for a RiggedService.
+// It serves the following endpoints:
+//
+//	GET  /status           service status
+//	POST /flush            flush pending operations
+//	POST /snapshot         take a snapshot
+//	GET  /log/{version}    decoded log batch starting at a hex version
+//	GET  /snapshots        available snapshot versions
+//
+// Use http.StripPrefix to mount it under a path.
+type Handler struct {
+	rs *rig.RiggedService
+}
+
+func NewHandler(rs *rig.RiggedService) *Handler {
+	return &Handler{
+		rs: rs,
+	}
+}
+
+type statusResponse struct {
+	Role                  string     `json:"role"`
+	Epoch                 uint64     `json:"epoch"`
+	CurrentVersion        uint64     `json:"current_version"`
+	LastFlush             uint64     `json:"last_flush"`
+	LastFlushTime         *time.Time `json:"last_flush_time,omitempty"`
+	LastSnapshot          uint64     `json:"last_snapshot"`
+	LastSnapshotTime      *time.Time `json:"last_snapshot_time,omitempty"`
+	Pending               int        `json:"pending"`
+	PendingBytes          int64      `json:"pending_bytes"`
+	AccessedMissingLog    bool       `json:"accessed_missing_log"`
+	LastFlushError        string     `json:"last_flush_error,omitempty"`
+	LastFlushErrorTime    *time.Time `json:"last_flush_error_time,omitempty"`
+	LastSnapshotError     string     `json:"last_snapshot_error,omitempty"`
+	LastSnapshotErrorTime *time.Time `json:"last_snapshot_error_time,omitempty"`
+}
+
+type logResponse struct {
+	Version    uint64          `json:"version"`
+	Operations []rig.Operation `json:"operations"`
+}
+
+type snapshotsResponse struct {
+	Latest   *uint64  `json:"latest,omitempty"`
+	Versions []uint64 `json:"versions"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	// Version is the version assigned to the last operation that was
+	// applied before one in the batch failed, if any were.
+	Version uint64 `json:"version,omitempty"`
+	// Index is the index of the operation that failed validation.
+	Index *int `json:"index,omitempty"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := "/" + strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "/status":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		h.serveStatus(w, r)
+	case path == "/flush":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		h.serveFlush(w, r)
+	case path == "/snapshot":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		h.serveSnapshot(w, r)
+	case strings.HasPrefix(path, "/log/"):
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		h.serveLog(w, r, strings.TrimPrefix(path, "/log/"))
+	case path == "/snapshots":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		h.serveSnapshots(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	status := h.rs.Status()
+	resp := statusResponse{
+		Role:                  status.Role.String(),
+		Epoch:                 status.Epoch,
+		CurrentVersion:        status.CurrentVersion,
+		LastFlush:             status.LastFlush,
+		LastFlushTime:         timePtr(status.LastFlushTime),
+		LastSnapshot:          status.LastSnapshot,
+		LastSnapshotTime:      timePtr(status.LastSnapshotTime),
+		Pending:               status.Pending,
+		PendingBytes:          status.PendingBytes,
+		AccessedMissingLog:    status.AccessedMissingLog,
+		LastFlushErrorTime:    timePtr(status.LastFlushErrorTime),
+		LastSnapshotErrorTime: timePtr(status.LastSnapshotErrorTime),
+	}
+	if status.LastFlushError != nil {
+		resp.LastFlushError = status.LastFlushError.Error()
+	}
+	if status.LastSnapshotError != nil {
+		resp.LastSnapshotError = status.LastSnapshotError.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) serveFlush(w http.ResponseWriter, r *http.Request) {
+	n, err := h.rs.Flush()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"flushed": n})
+}
+
+func (h *Handler) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	err := h.rs.Snapshot()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"version": h.rs.SnapshotVersion()})
+}
+
+func (h *Handler) serveLog(w http.ResponseWriter, r *http.Request, versionStr string) {
+	version, err := strconv.ParseUint(versionStr, 16, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid version")
+		return
+	}
+	ops, err := h.rs.Archive().ReadLogBatch(version)
+	if err != nil {
+		if rig.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, "log record not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, logResponse{
+		Version:    version,
+		Operations: ops,
+	})
+}
+
+func (h *Handler) serveSnapshots(w http.ResponseWriter, r *http.Request) {
+	archive := h.rs.Archive()
+	versions, err := archive.SnapshotVersions()
+	if err != nil {
+		if err == rig.ErrListUnsupported {
+			writeError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := snapshotsResponse{
+		Versions: versions,
+	}
+	latest, err := archive.LatestSnapshotVersion()
+	if err == nil {
+		resp.Latest = &latest
+	} else if !rig.IsNotExist(err) {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, errorResponse{Error: message})
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
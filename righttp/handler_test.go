@@ -0,0 +1,124 @@
+package righttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Preetam/rig"
+)
+
+type testService struct {
+	version uint64
+}
+
+func (s *testService) Version() (uint64, error) {
+	return s.version, nil
+}
+
+func (s *testService) Validate(op rig.Operation) error {
+	if op.Method == "invalid" {
+		return errors.New("invalid operation")
+	}
+	return nil
+}
+
+func (s *testService) Apply(version uint64, op rig.Operation) error {
+	if op.Method == "fail" {
+		return errors.New("failed operation")
+	}
+	s.version = version
+	return nil
+}
+
+func (s *testService) Snapshot() (io.ReadSeeker, int64, error) {
+	snapshot := []byte(fmt.Sprint(s.version))
+	return bytes.NewReader(snapshot), int64(len(snapshot)), nil
+}
+
+func (s *testService) Restore(version uint64, r io.Reader) error {
+	s.version = version
+	return nil
+}
+
+func newTestRiggedService(t *testing.T) (*rig.RiggedService, func()) {
+	dir, err := ioutil.TempDir("", "righttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := rig.NewRiggedService(&testService{}, rig.NewFileObjectStore(dir), "svc")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return rs, func() { os.RemoveAll(dir) }
+}
+
+func doRequest(t *testing.T, h http.Handler, method, path string, v interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if v != nil {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func TestHandler(t *testing.T) {
+	rs, cleanup := newTestRiggedService(t)
+	defer cleanup()
+	h := NewHandler(rs)
+
+	for i := 0; i < 3; i++ {
+		if err := rs.Apply(rig.Operation{Method: "op", Data: []byte{byte(i)}}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := statusResponse{}
+	if code := doRequest(t, h, "GET", "/status", &status); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if status.Role != "leader" || status.CurrentVersion != 3 || status.Pending != 3 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if code := doRequest(t, h, "GET", "/flush", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", code)
+	}
+	flushed := map[string]int{}
+	if code := doRequest(t, h, "POST", "/flush", &flushed); code != http.StatusOK || flushed["flushed"] != 3 {
+		t.Fatalf("unexpected flush response %d %v", code, flushed)
+	}
+
+	logResp := logResponse{}
+	if code := doRequest(t, h, "GET", "/log/0000000000000001", &logResp); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(logResp.Operations) != 3 || logResp.Operations[2].Data[0] != 2 {
+		t.Fatalf("unexpected log response %+v", logResp)
+	}
+	if code := doRequest(t, h, "GET", "/log/4", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+
+	if code := doRequest(t, h, "POST", "/snapshot", nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	snapshots := snapshotsResponse{}
+	if code := doRequest(t, h, "GET", "/snapshots", &snapshots); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(snapshots.Versions) != 1 || snapshots.Versions[0] != 3 || snapshots.Latest == nil || *snapshots.Latest != 3 {
+		t.Fatalf("unexpected snapshots response %+v", snapshots)
+	}
+}
@@ -0,0 +1,255 @@
+package righttp
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/Preetam/rig"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header that carries
+	// an idempotency key.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	maxRequestBytes    = 16 << 20
+	maxIdempotencyKeys = 10000
+)
+
+var errEmptyBatch = errors.New("righttp: empty batch")
+
+// IngressHandler is an http.Handler that applies operations to
+// a RiggedService. It accepts POST requests with a JSON body that
+// is either a single operation or an array of operations:
+//
+//	{"method": "set", "data": "<base64>"}
+//	[{"method": "set", "data": "<base64>"}, ...]
+//
+// The "durable" query parameter makes the request wait until the
+// operations are flushed. Requests with an Idempotency-Key header
+// are applied at most once; retries with the same key and body get
+// the original response.
+//
+// Responses are JSON objects with the versions assigned to the first
+// and last operations. Batches aren't atomic: if an operation fails,
+// the ones before it stay applied, and the error response has the
+// version assigned to the last of them, and the index of the operation
+// if it failed validation. Validation errors are reported with 400,
+// backpressure and rate limits with 429, and durability timeouts and
+// an unavailable leader with 503. Operations forwarded to the leader
+// without getting its response are reported with 504, and should only
+// be retried with an Idempotency-Key. Requests forwarded by a Forwarder
+// to a service that isn't the leader are reported with 421.
+type IngressHandler struct {
+	rs *rig.RiggedService
+
+	lock     sync.Mutex
+	requests map[string]*idempotentRequest
+	// order has the keys of requests, oldest first.
+	order *list.List
+}
+
+type idempotentRequest struct {
+	bodyHash [sha256.Size]byte
+	done     chan struct{}
+	// element is the request's key in order.
+	element *list.Element
+	// version is the version assigned to the last operation,
+	// or 0 if the operations were not all applied.
+	version uint64
+	// applied is the version assigned to the last operation that was
+	// applied, even if applying a later one failed, or 0 if none were.
+	applied uint64
+	code    int
+	resp    interface{}
+}
+
+type applyResponse struct {
+	FirstVersion uint64 `json:"first_version"`
+	Version      uint64 `json:"version"`
+}
+
+func NewIngressHandler(rs *rig.RiggedService) *IngressHandler {
+	return &IngressHandler{
+		rs:       rs,
+		requests: map[string]*idempotentRequest{},
+		order:    list.New(),
+	}
+}
+
+func (h *IngressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	durable := false
+	if durableStr := r.URL.Query().Get("durable"); durableStr != "" {
+		var err error
+		durable, err = strconv.ParseBool(durableStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid durable parameter")
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	ops, err := decodeOperations(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	if r.Header.Get(ForwardedHeader) != "" {
+		ctx = rig.WithoutForwarding(ctx)
+	}
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key != "" {
+		// Forwarded to the leader if this is a follower.
+		ctx = rig.WithIdempotencyKey(ctx, key)
+	}
+	if key == "" {
+		req := &idempotentRequest{}
+		h.apply(ctx, req, ops, durable)
+		writeJSON(w, req.code, req.resp)
+		return
+	}
+
+	bodyHash := sha256.Sum256(body)
+	req, existing := h.startRequest(key, bodyHash)
+	if !existing {
+		h.apply(ctx, req, ops, durable)
+		h.finishRequest(key, req)
+		writeJSON(w, req.code, req.resp)
+		return
+	}
+
+	select {
+	case <-req.done:
+	case <-r.Context().Done():
+		writeError(w, http.StatusServiceUnavailable, r.Context().Err().Error())
+		return
+	}
+	if req.bodyHash != bodyHash {
+		writeError(w, http.StatusUnprocessableEntity, "idempotency key reused with a different request")
+		return
+	}
+	if req.version == 0 {
+		writeJSON(w, req.code, req.resp)
+		return
+	}
+	// The operations were already applied, but this
+	// request may want to wait for durability.
+	code, resp := h.response(r.Context(), req.version, len(ops), durable)
+	writeJSON(w, code, resp)
+}
+
+// apply applies ops and sets the outcome on req.
+func (h *IngressHandler) apply(ctx context.Context, req *idempotentRequest, ops []rig.Operation, durable bool) {
+	version, err := h.rs.ApplyBatch(ctx, ops, false)
+	req.applied = version
+	if err != nil {
+		resp := errorResponse{Error: err.Error(), Version: version}
+		if validationErr, ok := err.(rig.ValidationError); ok {
+			resp.Index = &validationErr.Index
+		}
+		req.code, req.resp = errorStatus(err), resp
+		return
+	}
+	req.version = version
+	req.code, req.resp = h.response(ctx, version, len(ops), durable)
+}
+
+func (h *IngressHandler) response(ctx context.Context, version uint64, numOps int, durable bool) (int, interface{}) {
+	if durable {
+		err := h.rs.WaitUntilDurable(ctx, version)
+		if err != nil {
+			return errorStatus(err), errorResponse{Error: err.Error()}
+		}
+	}
+	return http.StatusOK, applyResponse{
+		FirstVersion: version - uint64(numOps) + 1,
+		Version:      version,
+	}
+}
+
+func errorStatus(err error) int {
+	if _, ok := err.(rig.ValidationError); ok {
+		return http.StatusBadRequest
+	}
+	if err == rig.ErrBackpressure || err == rig.ErrRateLimited {
+		return http.StatusTooManyRequests
+	}
+	if err == rig.ErrNotLeader {
+		return http.StatusMisdirectedRequest
+	}
+	if err == rig.ErrOutcomeUnknown {
+		return http.StatusGatewayTimeout
+	}
+	if err == rig.ErrTimeout || err == rig.ErrLeaderUnavailable || err == context.Canceled || err == context.DeadlineExceeded {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// startRequest returns the request for an idempotency key and whether
+// it already existed. New requests must be finished with finishRequest.
+func (h *IngressHandler) startRequest(key string, bodyHash [sha256.Size]byte) (*idempotentRequest, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if req, ok := h.requests[key]; ok {
+		return req, true
+	}
+	req := &idempotentRequest{
+		bodyHash: bodyHash,
+		done:     make(chan struct{}),
+		element:  h.order.PushBack(key),
+	}
+	h.requests[key] = req
+	for h.order.Len() > maxIdempotencyKeys {
+		delete(h.requests, h.order.Remove(h.order.Front()).(string))
+	}
+	return req, false
+}
+
+func (h *IngressHandler) finishRequest(key string, req *idempotentRequest) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if req.applied == 0 && req.code != http.StatusBadRequest && h.requests[key] == req {
+		// Nothing was applied, so let the client
+		// retry with the same key.
+		delete(h.requests, key)
+		h.order.Remove(req.element)
+	}
+	close(req.done)
+}
+
+func decodeOperations(body []byte) ([]rig.Operation, error) {
+	body = bytes.TrimSpace(body)
+	ops := []rig.Operation{}
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, err
+		}
+	} else {
+		op := rig.Operation{}
+		if err := json.Unmarshal(body, &op); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, errEmptyBatch
+	}
+	return ops, nil
+}
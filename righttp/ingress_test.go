@@ -0,0 +1,134 @@
+package righttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postOperations(ctx context.Context, t *testing.T, h http.Handler, path, key, body string) (int, applyResponse) {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body)).WithContext(ctx)
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	resp := applyResponse{}
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestIngressHandler(t *testing.T) {
+	rs, cleanup := newTestRiggedService(t)
+	defer cleanup()
+	h := NewIngressHandler(rs)
+	ctx := context.Background()
+
+	code, resp := postOperations(ctx, t, h, "/", "", `{"method":"set","data":"YQ=="}`)
+	if code != http.StatusOK || resp.FirstVersion != 1 || resp.Version != 1 {
+		t.Fatalf("unexpected response %d %+v", code, resp)
+	}
+	code, resp = postOperations(ctx, t, h, "/", "", `[{"method":"set"},{"method":"set"}]`)
+	if code != http.StatusOK || resp.FirstVersion != 2 || resp.Version != 3 {
+		t.Fatalf("unexpected response %d %+v", code, resp)
+	}
+	// The operation before the invalid one is applied, and the
+	// response has its version and the index of the invalid one.
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`[{"method":"set"},{"method":"invalid"},{"method":"set"}]`))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	errResp := errorResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || errResp.Version != 4 || errResp.Index == nil || *errResp.Index != 1 {
+		t.Fatalf("unexpected response %d %+v", w.Code, errResp)
+	}
+	if version := rs.Status().CurrentVersion; version != 4 {
+		t.Fatalf("expected version 4, got %d", version)
+	}
+	if code, _ = postOperations(ctx, t, h, "/", "", `[]`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+
+	// Idempotent requests are applied once.
+	for i := 0; i < 2; i++ {
+		code, resp = postOperations(ctx, t, h, "/", "key-1", `{"method":"set"}`)
+		if code != http.StatusOK || resp.Version != 5 {
+			t.Fatalf("unexpected response %d %+v", code, resp)
+		}
+	}
+	if code, _ = postOperations(ctx, t, h, "/", "key-1", `{"method":"other"}`); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", code)
+	}
+
+	// Nothing flushes, so durable requests time out.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if code, _ = postOperations(timeoutCtx, t, h, "/?durable=true", "key-2", `{"method":"set"}`); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", code)
+	}
+	if _, err := rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	code, resp = postOperations(ctx, t, h, "/?durable=true", "key-2", `{"method":"set"}`)
+	if code != http.StatusOK || resp.Version != 6 {
+		t.Fatalf("unexpected response %d %+v", code, resp)
+	}
+
+	// The first operation stays applied when the second one fails,
+	// so retries with the same key don't apply it again.
+	for i := 0; i < 2; i++ {
+		if code, _ = postOperations(ctx, t, h, "/", "key-3", `[{"method":"set"},{"method":"fail"}]`); code != http.StatusInternalServerError {
+			t.Fatalf("expected 500, got %d", code)
+		}
+		if version := rs.Status().CurrentVersion; version != 7 {
+			t.Fatalf("expected version 7, got %d", version)
+		}
+	}
+}
+
+func TestIdempotencyKeyRetries(t *testing.T) {
+	h := NewIngressHandler(nil)
+	bodyHash := sha256.Sum256(nil)
+	finish := func(key string, applied uint64) {
+		req, existed := h.startRequest(key, bodyHash)
+		if existed {
+			t.Fatalf("expected a new request for %s", key)
+		}
+		req.applied = applied
+		req.code = http.StatusInternalServerError
+		h.finishRequest(key, req)
+	}
+
+	// Requests that failed without applying anything aren't kept.
+	for i := 0; i <= maxIdempotencyKeys; i++ {
+		finish("retried", 0)
+	}
+	if h.order.Len() != 0 || len(h.requests) != 0 {
+		t.Fatalf("expected no keys, got %d in order and %d requests", h.order.Len(), len(h.requests))
+	}
+
+	// The retry that applied is kept until it's the oldest.
+	finish("retried", 1)
+	for i := 1; i < maxIdempotencyKeys; i++ {
+		finish(fmt.Sprint("key-", i), 1)
+	}
+	if _, existed := h.startRequest("retried", bodyHash); !existed {
+		t.Fatal("expected the retried key to be kept")
+	}
+	finish("key-new", 1)
+	if _, existed := h.requests["retried"]; existed || h.order.Len() != maxIdempotencyKeys {
+		t.Fatalf("expected the oldest key to be evicted, got %d keys", h.order.Len())
+	}
+}
@@ -0,0 +1,162 @@
+package rig
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// ErrUnknownMethod is returned by Router for
+// operations without a registered handler.
+type ErrUnknownMethod struct {
+	Method string
+}
+
+func (e ErrUnknownMethod) Error() string {
+	return fmt.Sprintf("rig: unknown method %q", e.Method)
+}
+
+// Router implements the Validate and Apply methods of Service by
+// dispatching operations to handlers registered for their method,
+// with Operation.Data decoded as JSON into a typed payload. Services
+// can embed a *Router and implement the rest of Service themselves.
+type Router struct {
+	routes map[string]route
+}
+
+type route struct {
+	// payloadType is the type that data is decoded into. Handlers
+	// that take a pointer get a pointer to a value of this type.
+	payloadType reflect.Type
+	apply       reflect.Value
+	applyPtr    bool
+	validate    reflect.Value
+	validatePtr bool
+}
+
+var (
+	uint64Type = reflect.TypeOf(uint64(0))
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+func NewRouter() *Router {
+	return &Router{
+		routes: map[string]route{},
+	}
+}
+
+// Handle registers the handlers for a method. apply must be a function
+// like
+//
+//	func(version uint64, payload T) error
+//
+// where T is any type that Operation.Data can be decoded into, or a
+// pointer to one. validate may be nil, or a function like
+//
+//	func(payload T) error
+//
+// with the same T, or a pointer to it. Empty data decodes to the zero
+// value. Handle panics if the handlers don't have valid types or the
+// method is already registered.
+func (r *Router) Handle(method string, apply interface{}, validate interface{}) {
+	if _, dup := r.routes[method]; dup {
+		panic("rig: Handle called twice for " + method)
+	}
+	applyValue := reflect.ValueOf(apply)
+	applyType := applyValue.Type()
+	if applyType.Kind() != reflect.Func || applyType.NumIn() != 2 || applyType.NumOut() != 1 ||
+		applyType.In(0) != uint64Type || applyType.Out(0) != errorType {
+		panic(fmt.Sprintf("rig: invalid apply handler type %v for %s", applyType, method))
+	}
+	rt := route{
+		apply: applyValue,
+	}
+	rt.payloadType, rt.applyPtr = derefType(applyType.In(1))
+
+	if validate != nil {
+		rt.validate = reflect.ValueOf(validate)
+		validateType := rt.validate.Type()
+		if validateType.Kind() != reflect.Func || validateType.NumIn() != 1 || validateType.NumOut() != 1 ||
+			validateType.Out(0) != errorType {
+			panic(fmt.Sprintf("rig: invalid validate handler type %v for %s", validateType, method))
+		}
+		var payloadType reflect.Type
+		payloadType, rt.validatePtr = derefType(validateType.In(0))
+		if payloadType != rt.payloadType {
+			panic(fmt.Sprintf("rig: validate handler payload %v doesn't match %v for %s",
+				payloadType, rt.payloadType, method))
+		}
+	}
+	r.routes[method] = rt
+}
+
+// Methods returns the registered methods.
+func (r *Router) Methods() []string {
+	methods := []string{}
+	for method := range r.routes {
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+// Validate decodes the payload of op and runs the validate
+// handler for its method, if there is one.
+func (r *Router) Validate(op Operation) error {
+	rt, ok := r.routes[op.Method]
+	if !ok {
+		return ErrUnknownMethod{Method: op.Method}
+	}
+	payload, err := rt.decode(op.Data)
+	if err != nil {
+		return err
+	}
+	if !rt.validate.IsValid() {
+		return nil
+	}
+	return callError(rt.validate, argument(payload, rt.validatePtr))
+}
+
+// Apply decodes the payload of op and runs the apply handler for its method.
+func (r *Router) Apply(version uint64, op Operation) error {
+	rt, ok := r.routes[op.Method]
+	if !ok {
+		return ErrUnknownMethod{Method: op.Method}
+	}
+	payload, err := rt.decode(op.Data)
+	if err != nil {
+		return err
+	}
+	return callError(rt.apply, reflect.ValueOf(version), argument(payload, rt.applyPtr))
+}
+
+// decode returns a pointer to the decoded payload.
+func (rt route) decode(data []byte) (reflect.Value, error) {
+	payload := reflect.New(rt.payloadType)
+	if len(data) == 0 {
+		return payload, nil
+	}
+	err := json.Unmarshal(data, payload.Interface())
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return payload, nil
+}
+
+func derefType(t reflect.Type) (reflect.Type, bool) {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem(), true
+	}
+	return t, false
+}
+
+func argument(payload reflect.Value, ptr bool) reflect.Value {
+	if ptr {
+		return payload
+	}
+	return payload.Elem()
+}
+
+func callError(fn reflect.Value, args ...reflect.Value) error {
+	err, _ := fn.Call(args)[0].Interface().(error)
+	return err
+}
@@ -0,0 +1,66 @@
+package rig
+
+import (
+	"errors"
+	"testing"
+)
+
+type setPayload struct {
+	Key   string `json:"key"`
+	Value int    `json:"value"`
+}
+
+func TestRouter(t *testing.T) {
+	state := map[string]int{}
+	r := NewRouter()
+	r.Handle("set", func(version uint64, p *setPayload) error {
+		state[p.Key] = p.Value
+		return nil
+	}, func(p setPayload) error {
+		if p.Key == "" {
+			return errors.New("empty key")
+		}
+		return nil
+	})
+	r.Handle("clear", func(version uint64, p struct{}) error {
+		state = map[string]int{}
+		return nil
+	}, nil)
+
+	set := Operation{Method: "set", Data: []byte(`{"key":"a","value":1}`)}
+	if err := r.Validate(set); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Apply(1, set); err != nil {
+		t.Fatal(err)
+	}
+	if state["a"] != 1 {
+		t.Fatalf("unexpected state %v", state)
+	}
+	if err := r.Validate(Operation{Method: "set", Data: []byte(`{"value":1}`)}); err == nil {
+		t.Fatal("expected a validation error")
+	}
+	if err := r.Validate(Operation{Method: "set", Data: []byte(`{`)}); err == nil {
+		t.Fatal("expected a decoding error")
+	}
+	if err := r.Apply(2, Operation{Method: "clear"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 0 {
+		t.Fatalf("unexpected state %v", state)
+	}
+
+	err := r.Validate(Operation{Method: "missing"})
+	if unknown, ok := err.(ErrUnknownMethod); !ok || unknown.Method != "missing" {
+		t.Fatalf("expected ErrUnknownMethod, got %v", err)
+	}
+}
+
+func TestRouterInvalidHandler(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	NewRouter().Handle("set", func(p *setPayload) error { return nil }, nil)
+}
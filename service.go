@@ -2,12 +2,13 @@ package rig
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math/rand"
 	"path/filepath"
 	"strconv"
 	"sync"
@@ -17,6 +18,27 @@ import (
 
 const sleepTimeSec = 10
 
+var (
+	// ErrTimeout is returned when an operation does not become
+	// durable in time.
+	ErrTimeout = errors.New("rig: timeout")
+	// ErrVersionMismatch is returned by ApplyIf when the current
+	// version isn't the expected version.
+	ErrVersionMismatch = errors.New("rig: version mismatch")
+)
+
+// ValidationError is returned by Apply when the service
+// rejects an operation during validation.
+type ValidationError struct {
+	Err error
+	// Index is the index of the rejected operation in its batch.
+	Index int
+}
+
+func (e ValidationError) Error() string {
+	return e.Err.Error()
+}
+
 type Service interface {
 	Version() (uint64, error)
 	Validate(Operation) error
@@ -28,54 +50,117 @@ type Service interface {
 type Operation struct {
 	Method string `json:"method"`
 	Data   []byte `json:"data"`
+	// Schema is the version of the format of Data. Services set it
+	// when they change the format, and register upcasters to convert
+	// operations with older schema versions.
+	Schema int `json:"schema,omitempty"`
+	// Timestamp and Seed are assigned by the leader when the operation
+	// is applied. Timestamp is in Unix nanoseconds. See Stamp.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	Seed      int64 `json:"seed,omitempty"`
 }
 
 type RiggedService struct {
-	service            Service
-	currentVersion     uint64
-	prefix             string
-	objectStore        ObjectStore
-	pending            []Operation
-	lastFlush          uint64
-	lastSnapshot       uint64
-	lastSnapshotTime   time.Time
-	accessedMissingLog bool
-	lock               sync.Mutex
+	service             Service
+	currentVersion      uint64
+	prefix              string
+	objectStore         ObjectStore
+	pending             []Operation
+	pendingBytes        int64
+	lastFlush           uint64
+	lastFlushTime       time.Time
+	lastFlushErr        error
+	lastFlushErrTime    time.Time
+	lastSnapshot        uint64
+	lastSnapshotTime    time.Time
+	lastSnapshotErr     error
+	lastSnapshotErrTime time.Time
+	accessedMissingLog  bool
+	// status is published from the fields above by publishStatus,
+	// so Status doesn't wait for rs.lock while it's held for I/O.
+	statusLock    sync.Mutex
+	status        Status
+	subscriptions map[*Subscription]struct{}
+	limits        Limits
+	batchLimits   BatchLimits
+	// digestInterval is the least number of versions between the
+	// digests recorded in log records, and lastDigest is the
+	// version of the last one.
+	digestInterval uint64
+	lastDigest     uint64
+	inFlight       *inFlightBatch
+	rateLimits     map[string]*tokenBucket
+	// drained is closed when pending operations are flushed.
+	drained   chan struct{}
+	upcasters *Upcasters
+	// wal is optional, and durability is when
+	// operations are durable if it's set.
+	wal        *WAL
+	durability Durability
+	// role and epoch are set by a Node, and leaseDeadline is when
+	// a leader stops writing unless its Node renews the lease.
+	// leaseHolder is the ID of the Node while it's the leader.
+	role          Role
+	epoch         uint64
+	leaseDeadline time.Time
+	leaseHolder   string
+	replication   *ReplicationServer
+	forwarding    ForwardConfig
+	// lastTimestamp is the latest timestamp stamped or applied,
+	// and seeds generates the seeds of stamps.
+	lastTimestamp int64
+	seeds         *rand.Rand
+	// chainHead is the hash of the last log record, if it's known,
+	// and chainSigned is true once a signed record was read or written.
+	chainHead   []byte
+	chainSigned bool
+	signingKey  ed25519.PrivateKey
+	verifyKey   ed25519.PublicKey
+	lock        sync.Mutex
 
 	now        func() int64
+	clock      func() int64
 	testSleep  bool // set to true during tests to avoid sleeping
 	firstFlush bool
 }
 
 func NewRiggedService(service Service, objectStore ObjectStore, prefix string) (*RiggedService, error) {
-	if dirObjectStore, ok := objectStore.(DirectoryCreator); ok {
-		err := dirObjectStore.CreateDirectory(filepath.Join(prefix, "LOG"))
-		if err != nil {
-			return nil, err
-		}
-		err = dirObjectStore.CreateDirectory(filepath.Join(prefix, "SNAPSHOT"))
-		if err != nil {
-			return nil, err
-		}
+	err := createDirectories(objectStore, prefix)
+	if err != nil {
+		return nil, err
 	}
 	currentVersion, err := service.Version()
 	if err != nil {
 		return nil, err
 	}
-	return &RiggedService{
+	rs := &RiggedService{
 		service:        service,
 		objectStore:    objectStore,
 		prefix:         prefix,
 		currentVersion: currentVersion,
+		upcasters:      NewUpcasters(),
+		batchLimits:    DefaultBatchLimits,
+		digestInterval: DefaultDigestInterval,
+		seeds:          rand.New(rand.NewSource(time.Now().UnixNano())),
 
 		now:        func() int64 { return time.Now().Unix() },
+		clock:      func() int64 { return time.Now().UnixNano() },
 		firstFlush: true,
-	}, nil
+	}
+	rs.publishStatus()
+	return rs, nil
 }
 
 func (rs *RiggedService) Recover() error {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
+	defer rs.publishStatus()
+	if preparer, ok := rs.objectStore.(RecoveryPreparer); ok {
+		err := preparer.PrepareRecovery(rs.prefix)
+		if err != nil {
+			return err
+		}
+	}
 	err := rs.recoverLatestSnapshot()
 	if err != nil {
 		return err
@@ -94,7 +179,7 @@ func (rs *RiggedService) Recover() error {
 				err = rs.recoverLogBatch(rs.currentVersion+1, int(rs.now()/sleepTimeSec))
 				if err != nil {
 					if err == errDoesNotExist {
-						return nil
+						return rs.recoverWAL()
 					}
 					return err
 				}
@@ -107,24 +192,42 @@ func (rs *RiggedService) Recover() error {
 	}
 }
 
+// recoverLatestSnapshot restores the latest snapshot, unless the
+// service already has its state and every version it has applied
+// since then is in the log, like a service that stores its state on
+// local disk. Then recovery only replays the versions after it.
 func (rs *RiggedService) recoverLatestSnapshot() error {
-	r, err := rs.objectStore.GetObject(rs.getLatestObjectName())
-	if err != nil {
-		if err == errDoesNotExist {
-			return nil
-		}
-		return err
+	archive := rs.Archive()
+	hasSnapshot := true
+	snapshotVersion, err := archive.LatestSnapshotVersion()
+	if err == errDoesNotExist {
+		hasSnapshot = false
+		err = nil
 	}
-	defer r.Close()
-	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	snapshotVersion, err := strconv.ParseUint(string(b), 16, 64)
+	localVersion, err := rs.service.Version()
 	if err != nil {
 		return err
 	}
-	sr, err := rs.objectStore.GetObject(rs.getSnapshotName(snapshotVersion))
+	if localVersion >= snapshotVersion && isDurable(archive, snapshotVersion, localVersion) {
+		rs.currentVersion = localVersion
+		rs.lastSnapshot = snapshotVersion
+		err = rs.recoverPartialLogBatch(archive)
+		if err != nil {
+			return err
+		}
+		if hasSnapshot && rs.currentVersion == snapshotVersion {
+			return rs.checkSnapshot(archive, snapshotVersion)
+		}
+		return rs.loadChainHead(archive)
+	}
+	if !hasSnapshot {
+		// There's nothing to restore, so keep the service's state.
+		return nil
+	}
+	sr, err := archive.OpenSnapshot(snapshotVersion)
 	if err != nil {
 		return err
 	}
@@ -135,7 +238,37 @@ func (rs *RiggedService) recoverLatestSnapshot() error {
 	}
 	rs.currentVersion = snapshotVersion
 	rs.lastSnapshot = snapshotVersion
-	return nil
+	return rs.checkSnapshot(archive, snapshotVersion)
+}
+
+// isDurable returns true if a version is in a snapshot or the log.
+// Versions after the last flush could have been lost, so a service
+// that applied them has to restore a snapshot instead.
+func isDurable(archive *Archive, snapshotVersion, version uint64) bool {
+	if version == snapshotVersion {
+		return true
+	}
+	_, _, err := findLogBatch(archive, version)
+	return err == nil
+}
+
+// recoverPartialLogBatch applies the rest of the log batch containing
+// the next version, if that version is in the middle of a batch.
+func (rs *RiggedService) recoverPartialLogBatch(archive *Archive) error {
+	version := rs.currentVersion + 1
+	_, err := archive.ReadLogBatch(version)
+	if err != errDoesNotExist {
+		// Recover starts with this batch.
+		return err
+	}
+	version, ops, err := findLogBatch(archive, version)
+	if err != nil {
+		if err == ErrHistoryUnavailable {
+			return nil
+		}
+		return err
+	}
+	return rs.applyLogBatch(version, ops)
 }
 
 func (rs *RiggedService) recoverLogBatch(version uint64, timestamp int) error {
@@ -144,22 +277,32 @@ func (rs *RiggedService) recoverLogBatch(version uint64, timestamp int) error {
 		// Append timestamp to the name
 		logObjectName += fmt.Sprintf("-%d", timestamp)
 	}
-	r, err := rs.objectStore.GetObject(logObjectName)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-	gzipReader, err := gzip.NewReader(r)
+	batch, hash, err := rs.readLogBatch(logObjectName, version)
 	if err != nil {
 		return err
 	}
-	pending := []Operation{}
-	err = json.NewDecoder(gzipReader).Decode(&pending)
+	err = rs.applyLogBatch(version, batch.Operations)
 	if err != nil {
 		return err
 	}
-	for _, op := range pending {
-		err = rs.service.Apply(version, op)
+	rs.advanceChain(batch, hash)
+	return rs.checkDigest(version+uint64(len(batch.Operations))-1, batch.Digest)
+}
+
+// applyLogBatch applies the operations in a log batch
+// starting at a version, skipping versions already applied.
+func (rs *RiggedService) applyLogBatch(version uint64, ops []Operation) error {
+	var err error
+	for _, op := range ops {
+		if version <= rs.currentVersion {
+			version++
+			continue
+		}
+		op, err = rs.upcasters.Upcast(op)
+		if err != nil {
+			return err
+		}
+		err = rs.applyOperation(version, op)
 		if err != nil {
 			return err
 		}
@@ -169,39 +312,130 @@ func (rs *RiggedService) recoverLogBatch(version uint64, timestamp int) error {
 	return nil
 }
 
-// Apply applies an operation.
+// Apply applies an operation. It is ApplyBatch with context.Background,
+// so with BackpressureBlock it waits until there is room. Use ApplyBatch
+// to be able to cancel it.
 func (rs *RiggedService) Apply(op Operation, waitUntilDurable bool) error {
-	err := rs.service.Validate(op)
-	if err != nil {
-		return err
+	_, err := rs.ApplyBatch(context.Background(), []Operation{op}, waitUntilDurable)
+	return err
+}
+
+// ApplyBatch applies operations in order and returns the version
+// assigned to the last one. Each operation is given a Stamp, replacing
+// the one it has, if any. The operations are subject to the limits
+// set with SetLimits and SetRateLimit, and then each one is validated
+// just before it is applied, without other operations being applied in
+// between. If waitUntilDurable is true, ApplyBatch waits until the
+// operations are flushed, the context is done, or it times out with
+// ErrTimeout.
+//
+// Batches aren't atomic: if validating or applying an operation fails,
+// the operations before it stay applied and the ones after it aren't,
+// and ApplyBatch returns the version assigned to the last applied one
+// along with the error, or 0 if none were applied. A ValidationError
+// has the index of the rejected operation in ops.
+//
+// If the service has a WAL, the operations that were applied are synced
+// to it before ApplyBatch returns, and it returns WALError along with
+// the version if that fails. Followers forward the operations to the
+// leader if forwarding is set with SetForwarding, and return
+// ErrNotLeader otherwise.
+func (rs *RiggedService) ApplyBatch(ctx context.Context, ops []Operation, waitUntilDurable bool) (uint64, error) {
+	if version, forwarded, err := rs.forward(ctx, ops, waitUntilDurable); forwarded {
+		return version, err
 	}
-	rs.lock.Lock()
-	err = rs.service.Apply(rs.currentVersion+1, op)
+	return rs.applyBatch(ctx, ops, waitUntilDurable, nil)
+}
+
+// ApplyIf applies an operation if the current version is expectedVersion,
+// and returns ErrVersionMismatch otherwise. Use it to apply an operation
+// computed from state read at a version. It returns the version assigned
+// to the operation like ApplyBatch. Followers don't forward it.
+func (rs *RiggedService) ApplyIf(ctx context.Context, expectedVersion uint64, op Operation, waitUntilDurable bool) (uint64, error) {
+	return rs.applyBatch(ctx, []Operation{op}, waitUntilDurable, &expectedVersion)
+}
+
+// applyBatch applies operations if the current version
+// is expectedVersion, or regardless of it if it's nil.
+func (rs *RiggedService) applyBatch(ctx context.Context, ops []Operation, waitUntilDurable bool, expectedVersion *uint64) (uint64, error) {
+	err := rs.admit(ctx, ops)
 	if err != nil {
+		return 0, err
+	}
+	if expectedVersion != nil && *expectedVersion != rs.currentVersion {
+		rs.refundTokens(ops)
 		rs.lock.Unlock()
-		return err
+		return 0, ErrVersionMismatch
+	}
+	stamped := make([]Operation, len(ops))
+	for i, op := range ops {
+		stamped[i] = rs.stamp(op)
+	}
+	ops = stamped
+	first := rs.currentVersion + 1
+	applied := 0
+	for i, op := range ops {
+		err = rs.service.Validate(op)
+		if err != nil {
+			err = ValidationError{Err: err, Index: i}
+			break
+		}
+		err = rs.applyOperation(rs.currentVersion+1, op)
+		if err != nil {
+			break
+		}
+		rs.currentVersion++
+		rs.pending = append(rs.pending, op)
+		rs.pendingBytes += operationSize(op)
+		applied++
+	}
+	// Operations that weren't applied don't count against the rate limits.
+	rs.refundTokens(ops[applied:])
+	rs.replicate(first, ops[:applied])
+	rs.publishStatus()
+	version := rs.currentVersion
+	if walErr := rs.appendWAL(first, ops[:applied]); walErr != nil && err == nil {
+		err = WALError{Version: version, Err: walErr}
 	}
-	rs.currentVersion++
-	rs.pending = append(rs.pending, op)
 	rs.lock.Unlock()
+	if err == nil {
+		if walErr := rs.syncWAL(version); walErr != nil {
+			err = WALError{Version: version, Err: walErr}
+		}
+	}
+	if err != nil {
+		if applied == 0 {
+			return 0, err
+		}
+		// The operations that were applied will be
+		// flushed, so they must not be applied again.
+		return version, err
+	}
 	if !waitUntilDurable {
-		return nil
+		return version, nil
 	}
+	return version, rs.WaitUntilDurable(ctx, version)
+}
 
-	waitFlushVersion := atomic.LoadUint64(&rs.currentVersion)
-
+// WaitUntilDurable waits until a version is flushed, or synced to the
+// WAL with DurableInWAL, the context is done, or it times out with
+// ErrTimeout.
+func (rs *RiggedService) WaitUntilDurable(ctx context.Context, version uint64) error {
+	if rs.durable(version) {
+		return nil
+	}
 	timeout := time.NewTimer(10 * time.Second)
 	checkTimer := time.NewTicker(100 * time.Millisecond)
+	defer timeout.Stop()
+	defer checkTimer.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-timeout.C:
-			timeout.Stop()
-			checkTimer.Stop()
-			return errors.New("rig: timeout")
+			return ErrTimeout
 		case <-checkTimer.C:
-			if atomic.LoadUint64(&rs.lastFlush) >= waitFlushVersion {
-				timeout.Stop()
-				checkTimer.Stop()
+			if rs.durable(version) {
 				return nil
 			}
 		}
@@ -212,46 +446,181 @@ func (rs *RiggedService) Apply(op Operation, waitUntilDurable bool) error {
 func (rs *RiggedService) Flush() (int, error) {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
+	defer rs.publishStatus()
 
-	numRecords := len(rs.pending)
-	if numRecords == 0 {
-		// Nothing to do
-		return 0, nil
+	numRecords, err := rs.flush()
+	if err != nil {
+		rs.lastFlushErr = err
+		rs.lastFlushErrTime = time.Now()
 	}
+	return numRecords, err
+}
 
-	batchVersion := rs.lastFlush + 1
+// flush writes the pending operations to one or more log records.
+// If writing a record fails, the operations in the records already
+// written are no longer pending, and flush returns how many there were.
+func (rs *RiggedService) flush() (int, error) {
+	flushed := 0
+	for {
+		// The lease can expire while batches are written.
+		if err := rs.writable(); err != nil {
+			return flushed, err
+		}
+		if rs.inFlight == nil {
+			if len(rs.pending) == 0 {
+				return flushed, nil
+			}
+			batch, err := rs.newInFlightBatch()
+			if err != nil {
+				return flushed, err
+			}
+			rs.inFlight = batch
+		}
+		err := rs.writeBatch(rs.inFlight)
+		if err != nil {
+			return flushed, err
+		}
+		flushed += rs.completeBatch(rs.inFlight)
+		rs.inFlight = nil
+	}
+}
 
-	buf := bytes.NewBuffer(nil)
-	w := gzip.NewWriter(buf)
-	err := json.NewEncoder(w).Encode(rs.pending)
-	if err != nil {
-		return 0, err
+// flushStep is the next object to write for a batch.
+type flushStep int
+
+const (
+	writeLogRecord flushStep = iota
+	// writeDuplicate writes the timestamped copy of the first
+	// log record written by the service.
+	writeDuplicate
+	flushComplete
+)
+
+// inFlightBatch is a log record that is being written. The operations
+// in a batch are fixed when it's created, so a batch that failed is
+// retried with the same contents and only the steps that didn't
+// finish. The operations stay pending until the batch is complete.
+type inFlightBatch struct {
+	version uint64
+	n       int
+	data    []byte
+	step    flushStep
+	// digest is the digest recorded in the batch, if any.
+	digest []byte
+	signed bool
+}
+
+// newInFlightBatch creates a batch with the next pending operations.
+// The batch records the digest of the service if it ends at the
+// current version and the digest interval has passed since the last
+// one.
+func (rs *RiggedService) newInFlightBatch() (*inFlightBatch, error) {
+	n := rs.nextBatch()
+	batch := &inFlightBatch{
+		version: rs.lastFlush + 1,
+		n:       n,
+	}
+	var err error
+	last := batch.version + uint64(n) - 1
+	if last == rs.currentVersion && rs.digestInterval > 0 && last-rs.lastDigest >= rs.digestInterval {
+		batch.digest, err = digest(rs.service)
+		if err != nil {
+			return nil, err
+		}
+		rs.lastDigest = last
+	}
+	record := logBatch{
+		Version:    batch.version,
+		Operations: rs.pending[:n],
+		Digest:     batch.digest,
+		Previous:   rs.chainHead,
+	}
+	if rs.signingKey != nil {
+		err = signLogBatch(&record, rs.signingKey)
+		if err != nil {
+			return nil, err
+		}
 	}
-	w.Flush()
-	w.Close()
-	err = rs.objectStore.PutObject(rs.getLogRecordName(batchVersion), bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	batch.signed = record.Signature != nil
+	buf, err := encodeLogBatch(record)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	batch.data = buf.Bytes()
+	return batch, nil
+}
 
-	if rs.firstFlush {
-		err = rs.objectStore.PutObject(fmt.Sprintf("%s-%d", rs.getLogRecordName(batchVersion), (rs.now()/sleepTimeSec+1)),
-			bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+// writeBatch writes the objects for a batch
+// that haven't been written yet.
+func (rs *RiggedService) writeBatch(batch *inFlightBatch) error {
+	for batch.step != flushComplete {
+		var err error
+		switch batch.step {
+		case writeLogRecord:
+			err = rs.checkLease()
+			if err == nil {
+				err = rs.objectStore.PutObject(rs.getLogRecordName(batch.version), bytes.NewReader(batch.data), int64(len(batch.data)))
+			}
+		case writeDuplicate:
+			if rs.firstFlush {
+				err = rs.objectStore.PutObject(fmt.Sprintf("%s-%d", rs.getLogRecordName(batch.version), (rs.now()/sleepTimeSec+1)),
+					bytes.NewReader(batch.data), int64(len(batch.data)))
+			}
+			if err == nil {
+				rs.firstFlush = false
+			}
+		}
 		if err != nil {
-			return 0, err
+			return err
 		}
-		rs.firstFlush = false
+		batch.step++
 	}
+	return nil
+}
 
-	rs.pending = rs.pending[:0]
-	rs.lastFlush = batchVersion + uint64(numRecords) - 1
-	return numRecords, nil
+// completeBatch makes a written batch durable and drops
+// its operations from pending. It returns how many there were.
+func (rs *RiggedService) completeBatch(batch *inFlightBatch) int {
+	ops := rs.pending[:batch.n]
+	atomic.StoreUint64(&rs.lastFlush, batch.version+uint64(batch.n)-1)
+	rs.lastFlushTime = time.Now()
+	rs.publish(batch.version, ops)
+	for _, op := range ops {
+		rs.pendingBytes -= operationSize(op)
+	}
+	rs.pending = append(rs.pending[:0], rs.pending[batch.n:]...)
+	rs.chainHead = hashLogRecord(batch.data)
+	rs.chainSigned = rs.chainSigned || batch.signed
+	rs.truncateWAL()
+	rs.replicateFlushed(batch.digest)
+	rs.signalDrained()
+	rs.publishStatus()
+	return batch.n
 }
 
 func (rs *RiggedService) Snapshot() error {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
+	defer rs.publishStatus()
+
+	err := rs.snapshot()
+	if err != nil {
+		rs.lastSnapshotErr = err
+		rs.lastSnapshotErrTime = time.Now()
+	}
+	return err
+}
 
+func (rs *RiggedService) snapshot() error {
+	if err := rs.writable(); err != nil {
+		return err
+	}
+	// Flush first so the log stays complete
+	// for subscribers reading history.
+	_, err := rs.flush()
+	if err != nil {
+		return err
+	}
 	snapshotVersion, err := rs.service.Version()
 	if err != nil {
 		return err
@@ -264,19 +633,11 @@ func (rs *RiggedService) Snapshot() error {
 			return nil
 		}
 	}
-	r, size, err := rs.service.Snapshot()
-	if err != nil {
-		return err
-	}
-	if closer, ok := r.(io.Closer); ok {
-		defer closer.Close()
-	}
-	err = rs.objectStore.PutObject(rs.getSnapshotName(snapshotVersion), r, size)
-	if err != nil {
-		return err
-	}
-	latestFileContents := []byte(strconv.FormatUint(snapshotVersion, 16))
-	err = rs.objectStore.PutObject(rs.getLatestObjectName(), bytes.NewReader(latestFileContents), int64(len(latestFileContents)))
+	snapshotDigest, err := putSnapshot(rs.objectStore, rs.prefix, rs.service, snapshotManifest{
+		Version:   snapshotVersion,
+		ChainHead: rs.chainHead,
+		Signed:    rs.chainSigned,
+	})
 	if err != nil {
 		return err
 	}
@@ -285,11 +646,8 @@ func (rs *RiggedService) Snapshot() error {
 	if rs.currentVersion < snapshotVersion {
 		rs.currentVersion = snapshotVersion
 	}
-	// We won't have any pending records anymore.
-	// TODO: keep all records since the last snapshot so we can
-	// support point-in-time recovery.
-	rs.pending = rs.pending[:0]
-	rs.lastFlush = snapshotVersion
+	atomic.StoreUint64(&rs.lastFlush, snapshotVersion)
+	rs.replicateFlushed(snapshotDigest)
 	return nil
 }
 
@@ -297,14 +655,69 @@ func (rs *RiggedService) SnapshotVersion() uint64 {
 	return atomic.LoadUint64(&rs.lastSnapshot)
 }
 
+// createDirectories creates the directories for a prefix
+// if the object store needs them.
+func createDirectories(objectStore ObjectStore, prefix string) error {
+	if dirObjectStore, ok := objectStore.(DirectoryCreator); ok {
+		err := dirObjectStore.CreateDirectory(filepath.Join(prefix, "LOG"))
+		if err != nil {
+			return err
+		}
+		err = dirObjectStore.CreateDirectory(filepath.Join(prefix, "SNAPSHOT"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putSnapshot stores a snapshot of service at the manifest's version
+// and the manifest, and points LATEST to it. It returns the digest in
+// the manifest, if the service has one.
+func putSnapshot(objectStore ObjectStore, prefix string, service Service, manifest snapshotManifest) ([]byte, error) {
+	version := manifest.Version
+	var err error
+	manifest.Digest, err = digest(service)
+	if err != nil {
+		return nil, err
+	}
+	r, size, err := service.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	err = objectStore.PutObject(snapshotName(prefix, version), r, size)
+	if err != nil {
+		return nil, err
+	}
+	manifestContents, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	err = objectStore.PutObject(snapshotManifestName(prefix, version), bytes.NewReader(manifestContents), int64(len(manifestContents)))
+	if err != nil {
+		return nil, err
+	}
+	latestFileContents := []byte(strconv.FormatUint(version, 16))
+	err = objectStore.PutObject(latestObjectName(prefix), bytes.NewReader(latestFileContents), int64(len(latestFileContents)))
+	return manifest.Digest, err
+}
+
+// Archive returns an Archive for the objects written by the service.
+func (rs *RiggedService) Archive() *Archive {
+	return NewArchive(rs.objectStore, rs.prefix)
+}
+
 func (rs *RiggedService) getSnapshotName(snapshot uint64) string {
-	return filepath.Join(rs.prefix, "SNAPSHOT", fmt.Sprintf("%016x", snapshot))
+	return snapshotName(rs.prefix, snapshot)
 }
 
 func (rs *RiggedService) getLogRecordName(version uint64) string {
-	return filepath.Join(rs.prefix, "LOG", fmt.Sprintf("%016x", version))
+	return logRecordName(rs.prefix, version)
 }
 
 func (rs *RiggedService) getLatestObjectName() string {
-	return filepath.Join(rs.prefix, "LATEST")
+	return latestObjectName(rs.prefix)
 }
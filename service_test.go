@@ -2,8 +2,11 @@ package rig
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -67,3 +70,177 @@ func TestSimple(t *testing.T) {
 	rs.Flush()
 	rs.Snapshot()
 }
+
+func TestStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rs, err := NewRiggedService(&testService{}, NewFileObjectStore(dir), "my_service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(Operation{Method: "set", Data: []byte("abc")}, false)
+	rs.Apply(Operation{Method: "set", Data: []byte("de")}, false)
+
+	status := rs.Status()
+	if status.CurrentVersion != 2 || status.Pending != 2 || status.PendingBytes != 11 {
+		t.Fatalf("unexpected status before flush: %+v", status)
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	status = rs.Status()
+	if status.LastFlush != 2 || status.Pending != 0 || status.PendingBytes != 0 || status.LastFlushTime.IsZero() {
+		t.Fatalf("unexpected status after flush: %+v", status)
+	}
+	if !status.AccessedMissingLog {
+		t.Fatal("expected recovery to access a missing log")
+	}
+}
+
+func TestStatusDuringFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rs, store := newFaultyRiggedService(t, dir)
+	rs.Apply(Operation{Method: "set", Data: []byte("abc")}, false)
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	store.setFail(func(name string) error {
+		close(writing)
+		<-release
+		return nil
+	})
+	flushed := make(chan error)
+	go func() {
+		_, err := rs.Flush()
+		flushed <- err
+	}()
+	<-writing
+	// Status doesn't wait for the log record to be written.
+	if status := rs.Status(); status.CurrentVersion != 1 || status.Pending != 1 {
+		t.Fatalf("unexpected status during flush: %+v", status)
+	}
+	store.setFail(nil)
+	close(release)
+	if err = <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if status := rs.Status(); status.LastFlush != 1 || status.Pending != 0 {
+		t.Fatalf("unexpected status after flush: %+v", status)
+	}
+}
+
+func TestApplyIf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rs, err := NewRiggedService(&testService{}, NewFileObjectStore(dir), "my_service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	op := Operation{Method: "set", Data: []byte("abc")}
+	if _, err = rs.ApplyIf(context.Background(), 1, op, false); err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch, got %v", err)
+	}
+	if version, err := rs.ApplyIf(context.Background(), 0, op, false); err != nil || version != 1 {
+		t.Fatalf("expected version 1, got %d and %v", version, err)
+	}
+	if _, err = rs.ApplyIf(context.Background(), 0, op, false); err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch after the version moved on, got %v", err)
+	}
+	if version, err := rs.ApplyIf(context.Background(), 1, op, false); err != nil || version != 2 {
+		t.Fatalf("expected version 2, got %d and %v", version, err)
+	}
+	if status := rs.Status(); status.CurrentVersion != 2 || status.Pending != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+// localService counts the operations it applies, and keeps its
+// state when it's recovered again, like a service on local disk.
+type localService struct {
+	testService
+	applied int
+}
+
+func (s *localService) Apply(version uint64, op Operation) error {
+	s.applied++
+	return s.testService.Apply(version, op)
+}
+
+func TestRecoverLocalState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectStore := NewFileObjectStore(dir)
+	service := &localService{}
+	recoverService := func(version uint64, applied int) *RiggedService {
+		t.Helper()
+		rs, err := NewRiggedService(service, objectStore, "svc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.testSleep = true
+		service.applied = 0
+		if err = rs.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		if service.version != version || service.applied != applied {
+			t.Fatalf("expected version %d after applying %d operations, got version %d after applying %d",
+				version, applied, service.version, service.applied)
+		}
+		return rs
+	}
+	op := Operation{Method: "set", Data: []byte("abc")}
+
+	rs := recoverService(0, 0)
+	if _, err = rs.ApplyBatch(context.Background(), []Operation{op, op, op, op, op}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(op, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rs.ApplyBatch(context.Background(), []Operation{op, op}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything the service has is in the log, so nothing is replayed.
+	rs = recoverService(8, 0)
+
+	// A version that isn't durable is discarded by
+	// restoring the snapshot and replaying the log.
+	rs.Apply(op, false)
+	recoverService(8, 3)
+
+	// A service that stopped in the middle of a log batch
+	// only replays the rest of the batch.
+	service.version = 7
+	recoverService(8, 1)
+}
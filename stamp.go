@@ -0,0 +1,78 @@
+package rig
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Stamp is assigned to an operation by the leader when it's applied,
+// and stored with the operation in the log. Services that need the
+// time or random numbers to apply an operation use its stamp instead,
+// so replaying the operation in Recover or on a follower reproduces
+// the same state.
+type Stamp struct {
+	// Time comes from a hybrid clock: it's the leader's wall clock,
+	// but always after the time of the previous operation, even if the
+	// clock goes backwards or another leader stamped that operation.
+	Time time.Time
+	// Seed is a random number for seeding a random number generator.
+	Seed int64
+}
+
+// Rand returns a random number generator seeded with the stamp's seed.
+func (s Stamp) Rand() *rand.Rand {
+	return rand.New(rand.NewSource(s.Seed))
+}
+
+// StampedService is a Service that uses the time or random numbers to
+// apply operations. RiggedService calls ApplyStamped instead of Apply
+// with the stamp of each operation. Operations written before stamps
+// were added have a zero stamp.
+type StampedService interface {
+	Service
+	ApplyStamped(version uint64, op Operation, stamp Stamp) error
+}
+
+// Stamp returns the stamp assigned to the operation.
+func (op Operation) Stamp() Stamp {
+	stamp := Stamp{Seed: op.Seed}
+	if op.Timestamp != 0 {
+		stamp.Time = time.Unix(0, op.Timestamp)
+	}
+	return stamp
+}
+
+// applyOperation applies an operation, passing its
+// stamp if the service is a StampedService.
+func applyOperation(service Service, version uint64, op Operation) error {
+	if stamped, ok := service.(StampedService); ok {
+		return stamped.ApplyStamped(version, op, op.Stamp())
+	}
+	return service.Apply(version, op)
+}
+
+// applyOperation applies an operation to the service and advances the
+// clock past its timestamp. The caller must hold rs.lock.
+func (rs *RiggedService) applyOperation(version uint64, op Operation) error {
+	err := applyOperation(rs.service, version, op)
+	if err != nil {
+		return err
+	}
+	if op.Timestamp > rs.lastTimestamp {
+		rs.lastTimestamp = op.Timestamp
+	}
+	return nil
+}
+
+// stamp returns op with the next timestamp and a new seed.
+// The caller must hold rs.lock.
+func (rs *RiggedService) stamp(op Operation) Operation {
+	timestamp := rs.clock()
+	if timestamp <= rs.lastTimestamp {
+		timestamp = rs.lastTimestamp + 1
+	}
+	rs.lastTimestamp = timestamp
+	op.Timestamp = timestamp
+	op.Seed = rs.seeds.Int63()
+	return op
+}
@@ -0,0 +1,82 @@
+package rig
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stampedService records a random number and
+// the time of each operation it applies.
+type stampedService struct {
+	testService
+	times  []time.Time
+	values []int64
+}
+
+func (s *stampedService) ApplyStamped(version uint64, op Operation, stamp Stamp) error {
+	s.times = append(s.times, stamp.Time)
+	s.values = append(s.values, stamp.Rand().Int63())
+	return s.testService.Apply(version, op)
+}
+
+func TestStampReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	service := &stampedService{}
+	rs, err := NewRiggedService(service, NewFileObjectStore(dir), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	// The clock goes backwards after the second operation.
+	clock := []int64{1000, 2000, 1500, 3000}
+	rs.clock = func() int64 {
+		now := clock[0]
+		clock = clock[1:]
+		return now
+	}
+	op := Operation{Method: "set", Data: []byte("abc"), Timestamp: 1, Seed: 1}
+	for i := 0; i < 4; i++ {
+		if err = rs.Apply(op, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Time{time.Unix(0, 1000), time.Unix(0, 2000), time.Unix(0, 2001), time.Unix(0, 3000)}
+	if !reflect.DeepEqual(service.times, expected) {
+		t.Fatalf("expected times %v, got %v", expected, service.times)
+	}
+
+	replayed := &stampedService{}
+	rs, err = NewRiggedService(replayed, NewFileObjectStore(dir), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.testSleep = true
+	if err = rs.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed.times, service.times) || !reflect.DeepEqual(replayed.values, service.values) {
+		t.Fatalf("replay stamped %v %v, expected %v %v", replayed.times, replayed.values, service.times, service.values)
+	}
+	// The clock continues after the operations that were replayed.
+	rs.clock = func() int64 { return 500 }
+	if err = rs.Apply(op, false); err != nil {
+		t.Fatal(err)
+	}
+	if last := replayed.times[len(replayed.times)-1]; !last.Equal(time.Unix(0, 3001)) {
+		t.Fatalf("expected the next operation to be stamped after the last one, got %v", last)
+	}
+}
@@ -0,0 +1,78 @@
+package rig
+
+import (
+	"time"
+)
+
+// Status describes the state of a RiggedService at a point in time.
+type Status struct {
+	// Role is Follower if the service is run by a Node that
+	// isn't the leader, and Epoch is the epoch of the lease
+	// it last held.
+	Role           Role
+	Epoch          uint64
+	CurrentVersion uint64
+	LastFlush      uint64
+	LastFlushTime  time.Time
+	LastSnapshot   uint64
+	// LastSnapshotTime is the time the last snapshot was taken
+	// by this process. It is zero if the snapshot was recovered.
+	LastSnapshotTime time.Time
+
+	// Pending is the number of applied operations that have not
+	// been flushed yet, and PendingBytes is their approximate size.
+	Pending      int
+	PendingBytes int64
+
+	// AccessedMissingLog is true if recovery reached the end of the
+	// log and had to fall back to timestamped log records.
+	AccessedMissingLog bool
+
+	// LastFlushError and LastSnapshotError are the most recent errors
+	// returned by Flush and Snapshot, along with the time they occurred.
+	// They are not cleared by later successful calls; compare the
+	// timestamps with LastFlushTime and LastSnapshotTime instead.
+	LastFlushError        error
+	LastFlushErrorTime    time.Time
+	LastSnapshotError     error
+	LastSnapshotErrorTime time.Time
+}
+
+// Status returns the current status of the service. It is safe to
+// call concurrently with other methods, and doesn't wait for flushes
+// and snapshots in progress, so it shows the status before them.
+func (rs *RiggedService) Status() Status {
+	rs.statusLock.Lock()
+	defer rs.statusLock.Unlock()
+	return rs.status
+}
+
+// publishStatus updates the status returned by Status.
+// The caller must hold rs.lock.
+func (rs *RiggedService) publishStatus() {
+	status := Status{
+		Role:                  rs.role,
+		Epoch:                 rs.epoch,
+		CurrentVersion:        rs.currentVersion,
+		LastFlush:             rs.lastFlush,
+		LastFlushTime:         rs.lastFlushTime,
+		LastSnapshot:          rs.lastSnapshot,
+		LastSnapshotTime:      rs.lastSnapshotTime,
+		Pending:               len(rs.pending),
+		PendingBytes:          rs.pendingBytes,
+		AccessedMissingLog:    rs.accessedMissingLog,
+		LastFlushError:        rs.lastFlushErr,
+		LastFlushErrorTime:    rs.lastFlushErrTime,
+		LastSnapshotError:     rs.lastSnapshotErr,
+		LastSnapshotErrorTime: rs.lastSnapshotErrTime,
+	}
+	rs.statusLock.Lock()
+	rs.status = status
+	rs.statusLock.Unlock()
+}
+
+// operationSize returns the approximate number of bytes
+// an operation occupies in memory.
+func operationSize(op Operation) int64 {
+	return int64(len(op.Method) + len(op.Data))
+}
@@ -0,0 +1,228 @@
+package rig
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// subscriptionBufferBatches is the number of flushed batches buffered
+// for a subscriber before it falls back to reading the object store.
+const subscriptionBufferBatches = 16
+
+// ErrHistoryUnavailable is returned by Subscription.Err when the
+// log records needed to catch up no longer exist.
+var ErrHistoryUnavailable = errors.New("rig: history unavailable")
+
+// Change is an operation applied at a version.
+type Change struct {
+	Version   uint64
+	Operation Operation
+}
+
+// Subscription delivers durable changes in version order.
+type Subscription struct {
+	// C receives the changes. It is closed when the subscription
+	// is closed or fails; check Err afterwards.
+	C <-chan Change
+
+	rs   *RiggedService
+	c    chan Change
+	next uint64
+	live chan changeBatch
+	// wake is signaled when a batch is dropped
+	// because live is full.
+	wake chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+	err       atomic.Value
+}
+
+type changeBatch struct {
+	version uint64
+	ops     []Operation
+}
+
+// Subscribe returns a subscription to the changes starting at fromVersion.
+// Changes already in the object store are read from the log and upcasted,
+// and then changes are delivered as they are flushed. Subscribers that
+// fall behind catch up from the object store, so they never block Apply
+// or Flush.
+func (rs *RiggedService) Subscribe(fromVersion uint64) *Subscription {
+	if fromVersion == 0 {
+		fromVersion = 1
+	}
+	c := make(chan Change)
+	s := &Subscription{
+		C:    c,
+		rs:   rs,
+		c:    c,
+		next: fromVersion,
+		live: make(chan changeBatch, subscriptionBufferBatches),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	rs.lock.Lock()
+	if rs.subscriptions == nil {
+		rs.subscriptions = map[*Subscription]struct{}{}
+	}
+	rs.subscriptions[s] = struct{}{}
+	rs.lock.Unlock()
+	go s.run()
+	return s
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.rs.lock.Lock()
+		delete(s.rs.subscriptions, s)
+		s.rs.lock.Unlock()
+		close(s.done)
+	})
+}
+
+// Err returns the error that ended the subscription, if any.
+func (s *Subscription) Err() error {
+	if err, ok := s.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// publish hands a flushed batch to the subscribers.
+// The caller must hold rs.lock.
+func (rs *RiggedService) publish(version uint64, ops []Operation) {
+	if len(rs.subscriptions) == 0 {
+		return
+	}
+	batch := changeBatch{
+		version: version,
+		ops:     append([]Operation(nil), ops...),
+	}
+	for s := range rs.subscriptions {
+		select {
+		case s.live <- batch:
+		default:
+			// The subscriber is behind, so it will
+			// have to read from the object store.
+			select {
+			case s.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Subscription) run() {
+	defer close(s.c)
+	for {
+		if s.next <= atomic.LoadUint64(&s.rs.lastFlush) {
+			err := s.catchUp()
+			if err != nil {
+				s.fail(err)
+				return
+			}
+			continue
+		}
+		select {
+		case batch := <-s.live:
+			if batch.version > s.next {
+				// Missed a batch. Catch up from the store.
+				continue
+			}
+			if !s.deliver(batch.version, batch.ops) {
+				return
+			}
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// catchUp reads changes from the object store
+// until it reaches the last flushed version.
+func (s *Subscription) catchUp() error {
+	archive := s.rs.Archive()
+	for s.next <= atomic.LoadUint64(&s.rs.lastFlush) {
+		version := s.next
+		ops, err := archive.ReadLogBatch(version)
+		if IsNotExist(err) {
+			// The subscription may start in the middle of a batch.
+			version, ops, err = findLogBatch(archive, s.next)
+		}
+		if err != nil {
+			return err
+		}
+		for i := range ops {
+			ops[i], err = s.rs.upcasters.Upcast(ops[i])
+			if err != nil {
+				return err
+			}
+		}
+		if !s.deliver(version, ops) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// deliver sends the changes in a batch that the subscriber
+// hasn't seen. It returns false if the subscription is closed.
+func (s *Subscription) deliver(version uint64, ops []Operation) bool {
+	for _, op := range ops {
+		if version >= s.next {
+			select {
+			case s.c <- Change{Version: version, Operation: op}:
+			case <-s.done:
+				return false
+			}
+			s.next = version + 1
+		}
+		version++
+	}
+	return true
+}
+
+func (s *Subscription) fail(err error) {
+	s.err.Store(err)
+	s.rs.lock.Lock()
+	delete(s.rs.subscriptions, s)
+	s.rs.lock.Unlock()
+}
+
+// findLogBatch returns the log record that contains a version.
+func findLogBatch(archive *Archive, version uint64) (uint64, []Operation, error) {
+	records, err := archive.LogRecords()
+	if err != nil {
+		if err == ErrListUnsupported {
+			return 0, nil, ErrHistoryUnavailable
+		}
+		return 0, nil, err
+	}
+	names := []string{}
+	var batchVersion uint64
+	for _, record := range records {
+		if record.Version > version {
+			break
+		}
+		if record.Version != batchVersion {
+			names = names[:0]
+		}
+		batchVersion = record.Version
+		names = append(names, record.Name)
+	}
+	if len(names) == 0 {
+		return 0, nil, ErrHistoryUnavailable
+	}
+	ops, err := readFirstLogRecord(archive, names)
+	if err != nil {
+		return 0, nil, err
+	}
+	if batchVersion+uint64(len(ops)) <= version {
+		return 0, nil, ErrHistoryUnavailable
+	}
+	return batchVersion, ops, nil
+}
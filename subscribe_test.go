@@ -0,0 +1,89 @@
+package rig
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func receiveChanges(t *testing.T, s *Subscription, n int) []Change {
+	changes := []Change{}
+	timeout := time.After(5 * time.Second)
+	for len(changes) < n {
+		select {
+		case change, ok := <-s.C:
+			if !ok {
+				t.Fatalf("subscription closed: %v", s.Err())
+			}
+			changes = append(changes, change)
+		case <-timeout:
+			t.Fatalf("timed out after %d changes", len(changes))
+		}
+	}
+	return changes
+}
+
+func TestSubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rs, err := NewRiggedService(&testService{}, NewFileObjectStore(dir), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		rs.Apply(Operation{Data: []byte{byte(i)}}, false)
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start in the middle of a flushed batch.
+	s := rs.Subscribe(2)
+	defer s.Close()
+	changes := receiveChanges(t, s, 2)
+	if changes[0].Version != 2 || changes[1].Version != 3 || changes[1].Operation.Data[0] != 2 {
+		t.Fatalf("unexpected history %+v", changes)
+	}
+
+	// Pending operations aren't delivered until they're durable.
+	rs.Apply(Operation{Data: []byte{3}}, false)
+	select {
+	case change := <-s.C:
+		t.Fatalf("unexpected change before flush %+v", change)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	changes = receiveChanges(t, s, 1)
+	if changes[0].Version != 4 || changes[0].Operation.Data[0] != 3 {
+		t.Fatalf("unexpected live change %+v", changes)
+	}
+
+	// A slow subscriber catches up from the object store.
+	for i := 0; i < 2*subscriptionBufferBatches; i++ {
+		rs.Apply(Operation{}, false)
+		if _, err = rs.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes = receiveChanges(t, s, 2*subscriptionBufferBatches)
+	for i, change := range changes {
+		if change.Version != uint64(5+i) {
+			t.Fatalf("expected version %d, got %d", 5+i, change.Version)
+		}
+	}
+
+	s.Close()
+	if _, ok := <-s.C; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+	if s.Err() != nil {
+		t.Fatal(s.Err())
+	}
+}
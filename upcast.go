@@ -0,0 +1,75 @@
+package rig
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Upcaster transforms an operation written with an older schema
+// version. The returned operation must have a newer schema version.
+type Upcaster func(Operation) (Operation, error)
+
+// Upcasters is a set of upcasters registered by method and schema
+// version. They are applied to operations read from the log before
+// they are passed to Service.Apply, so operation payloads can evolve
+// without rewriting history. A nil *Upcasters has no upcasters.
+type Upcasters struct {
+	lock      sync.RWMutex
+	upcasters map[upcasterKey]Upcaster
+}
+
+type upcasterKey struct {
+	method string
+	schema int
+}
+
+func NewUpcasters() *Upcasters {
+	return &Upcasters{
+		upcasters: map[upcasterKey]Upcaster{},
+	}
+}
+
+// Register adds an upcaster for operations with a method
+// and schema version. It panics if one is already registered.
+func (u *Upcasters) Register(method string, fromSchema int, upcaster Upcaster) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	key := upcasterKey{method: method, schema: fromSchema}
+	if _, dup := u.upcasters[key]; dup {
+		panic(fmt.Sprintf("rig: upcaster registered twice for %s schema %d", method, fromSchema))
+	}
+	u.upcasters[key] = upcaster
+}
+
+// Upcast applies upcasters to op until there are none
+// registered for its method and schema version.
+func (u *Upcasters) Upcast(op Operation) (Operation, error) {
+	if u == nil {
+		return op, nil
+	}
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	for {
+		upcaster, ok := u.upcasters[upcasterKey{method: op.Method, schema: op.Schema}]
+		if !ok {
+			return op, nil
+		}
+		upcasted, err := upcaster(op)
+		if err != nil {
+			return op, err
+		}
+		if upcasted.Schema <= op.Schema {
+			return op, fmt.Errorf("rig: upcaster for %s schema %d returned schema %d",
+				op.Method, op.Schema, upcasted.Schema)
+		}
+		// Upcasting doesn't change when the operation was applied.
+		upcasted.Timestamp, upcasted.Seed = op.Timestamp, op.Seed
+		op = upcasted
+	}
+}
+
+// RegisterUpcaster adds an upcaster used when recovering operations
+// from the log. Upcasters must be registered before calling Recover.
+func (rs *RiggedService) RegisterUpcaster(method string, fromSchema int, upcaster Upcaster) {
+	rs.upcasters.Register(method, fromSchema, upcaster)
+}
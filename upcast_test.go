@@ -0,0 +1,90 @@
+package rig
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// recordingService records the operations it applies.
+type recordingService struct {
+	testService
+	ops []Operation
+}
+
+func (s *recordingService) Apply(version uint64, op Operation) error {
+	s.ops = append(s.ops, op)
+	return s.testService.Apply(version, op)
+}
+
+func (s *recordingService) Restore(version uint64, r io.Reader) error {
+	s.ops = nil
+	return s.testService.Restore(version, r)
+}
+
+func TestUpcastDuringRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectStore := NewFileObjectStore(dir)
+
+	rs, err := NewRiggedService(&testService{}, objectStore, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(Operation{Method: "set", Data: []byte("a")}, false)
+	rs.Apply(Operation{Method: "set", Data: []byte("b"), Schema: 2}, false)
+	rs.Apply(Operation{Method: "delete", Data: []byte("c")}, false)
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &recordingService{}
+	recovered, err := NewRiggedService(service, objectStore, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered.testSleep = true
+	recovered.RegisterUpcaster("set", 0, func(op Operation) (Operation, error) {
+		op.Data = append([]byte("v1:"), op.Data...)
+		op.Schema = 1
+		return op, nil
+	})
+	recovered.RegisterUpcaster("set", 1, func(op Operation) (Operation, error) {
+		op.Data = append([]byte("v2:"), op.Data...)
+		op.Schema = 2
+		return op, nil
+	})
+	if err = recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"v2:v1:a", "b", "c"}
+	if len(service.ops) != len(expected) {
+		t.Fatalf("unexpected operations %+v", service.ops)
+	}
+	for i, op := range service.ops {
+		if string(op.Data) != expected[i] {
+			t.Errorf("expected %q at %d, got %q", expected[i], i, op.Data)
+		}
+	}
+	if service.ops[0].Schema != 2 || service.ops[2].Schema != 0 {
+		t.Fatalf("unexpected schema versions %+v", service.ops)
+	}
+}
+
+func TestUpcasterMustIncreaseSchema(t *testing.T) {
+	upcasters := NewUpcasters()
+	upcasters.Register("set", 1, func(op Operation) (Operation, error) {
+		return op, nil
+	})
+	if _, err := upcasters.Upcast(Operation{Method: "set", Schema: 1}); err == nil {
+		t.Fatal("expected an error")
+	}
+	var none *Upcasters
+	if op, err := none.Upcast(Operation{Method: "set"}); err != nil || op.Method != "set" {
+		t.Fatalf("unexpected result %+v %v", op, err)
+	}
+}
@@ -0,0 +1,97 @@
+package rig
+
+// VersionRange is an inclusive range of versions.
+type VersionRange struct {
+	First uint64
+	Last  uint64
+}
+
+// VerifyReport describes the result of Archive.Verify.
+type VerifyReport struct {
+	// SnapshotVersion is the version of the latest snapshot, or 0
+	// if there is none.
+	SnapshotVersion uint64
+	// LastVersion is the last version covered by the log after
+	// the snapshot.
+	LastVersion uint64
+	// Batches is the number of log records checked.
+	Batches int
+
+	// Gaps are versions missing from the log.
+	Gaps []VersionRange
+	// Duplicates are versions covered by more than one log record.
+	Duplicates []VersionRange
+	// Undecodable are the names of log records that could not be read.
+	Undecodable []string
+}
+
+// OK returns true if the report found no problems.
+func (r *VerifyReport) OK() bool {
+	return len(r.Gaps) == 0 && len(r.Duplicates) == 0 && len(r.Undecodable) == 0
+}
+
+// Verify checks the continuity of versions from the latest snapshot
+// through all of the log records.
+func (a *Archive) Verify() (*VerifyReport, error) {
+	report := &VerifyReport{}
+	snapshotVersion, err := a.LatestSnapshotVersion()
+	if err != nil && !IsNotExist(err) {
+		return nil, err
+	}
+	report.SnapshotVersion = snapshotVersion
+
+	records, err := a.LogRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	next := snapshotVersion + 1
+	for i := 0; i < len(records); {
+		// Timestamped copies sort after the record they duplicate, so use the
+		// first record for a version that can be decoded.
+		version := records[i].Version
+		var ops []Operation
+		for ; i < len(records) && records[i].Version == version; i++ {
+			if ops != nil {
+				continue
+			}
+			ops, err = a.ReadLogRecord(records[i].Name)
+			if err != nil {
+				if IsNotExist(err) {
+					// Deleted since it was listed.
+					continue
+				}
+				report.Undecodable = append(report.Undecodable, records[i].Name)
+				ops = nil
+			}
+		}
+		if len(ops) == 0 {
+			continue
+		}
+		last := version + uint64(len(ops)) - 1
+		if last <= snapshotVersion {
+			// Covered by the snapshot.
+			continue
+		}
+		report.Batches++
+		if version > next {
+			report.Gaps = append(report.Gaps, VersionRange{First: next, Last: version - 1})
+		}
+		// Overlapping the snapshot is fine, but not another record.
+		duplicateFirst, duplicateLast := version, next-1
+		if duplicateFirst <= snapshotVersion {
+			duplicateFirst = snapshotVersion + 1
+		}
+		if last < duplicateLast {
+			duplicateLast = last
+		}
+		if duplicateFirst <= duplicateLast {
+			report.Duplicates = append(report.Duplicates, VersionRange{First: duplicateFirst, Last: duplicateLast})
+		}
+		if last+1 > next {
+			next = last + 1
+		}
+	}
+	report.LastVersion = next - 1
+	return report, nil
+}
@@ -0,0 +1,521 @@
+package rig
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	walSuffix = ".wal"
+	// DefaultWALSegmentSize is the size of WAL segments
+	// before a new one is started.
+	DefaultWALSegmentSize = 64 << 20
+	walRecordHeaderSize   = 8
+)
+
+var errWALCorrupt = errors.New("rig: corrupt WAL record")
+
+// Durability is when ApplyBatch and WaitUntilDurable
+// consider operations to be durable.
+type Durability int
+
+const (
+	// DurableInObjectStore waits until operations are flushed.
+	DurableInObjectStore Durability = iota
+	// DurableInWAL waits until operations are synced to the WAL.
+	DurableInWAL
+)
+
+// WALError is returned by ApplyBatch when operations were applied but
+// writing or syncing them to the WAL failed. They are replicated and
+// will be flushed like other operations, so they must not be applied
+// again, but they aren't durable locally until then.
+type WALError struct {
+	// Version is the version of the last operation that was applied.
+	Version uint64
+	Err     error
+}
+
+func (e WALError) Error() string {
+	return fmt.Sprintf("rig: version %d was applied but not written to the WAL: %v", e.Version, e.Err)
+}
+
+// WAL is a local write-ahead log of operations, stored in segment files
+// in a directory. Segments are named after the first version in them.
+//
+// Each record is a uint32 length and CRC-32 of the payload, followed by
+// the payload: the uint64 version and the operation encoded as JSON.
+// A record that was only partially written when the process stopped is
+// discarded when the WAL is opened, and one that was partially written
+// when Append failed is discarded before Append returns.
+type WAL struct {
+	dir         string
+	segmentSize int64
+
+	lock     sync.Mutex
+	segments []uint64 // first versions, in order
+	file     *os.File
+	w        *bufio.Writer
+	size     int64
+	last     uint64
+	// written and writtenLast are the size of the current segment
+	// and the last version when w was last flushed successfully.
+	written     int64
+	writtenLast uint64
+
+	// syncLock is held while syncing, so concurrent
+	// calls to Sync share one fsync.
+	syncLock sync.Mutex
+	synced   uint64
+}
+
+// OpenWAL opens the WAL in dir, creating it if necessary. A
+// segmentSize of 0 uses DefaultWALSegmentSize.
+func OpenWAL(dir string, segmentSize int64) (*WAL, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultWALSegmentSize
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		dir:         dir,
+		segmentSize: segmentSize,
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), walSuffix) {
+			continue
+		}
+		version, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), walSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		w.segments = append(w.segments, version)
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i] < w.segments[j] })
+	if len(w.segments) == 0 {
+		return w, nil
+	}
+
+	// Find the end of the last segment.
+	name := w.segmentName(w.segments[len(w.segments)-1])
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	end := int64(0)
+	err = readWALRecords(f, func(version uint64, op Operation, offset int64) error {
+		w.last = version
+		end = offset
+		return nil
+	})
+	if err != nil && err != errWALCorrupt {
+		f.Close()
+		return nil, err
+	}
+	if w.last == 0 && len(w.segments) > 1 {
+		// The last segment is empty, so the last version
+		// is in the segment before it.
+		w.last = w.segments[len(w.segments)-1] - 1
+	}
+	// Discard a partially written record.
+	err = f.Truncate(end)
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.file = f
+	w.w = bufio.NewWriter(f)
+	w.size = end
+	w.written = end
+	w.writtenLast = w.last
+	w.synced = w.last
+	return w, nil
+}
+
+func (w *WAL) segmentName(version uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%016x%s", version, walSuffix))
+}
+
+// LastVersion returns the last version appended to the WAL.
+func (w *WAL) LastVersion() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.last
+}
+
+// Append writes operations starting at a version. They aren't durable
+// until Sync returns. If it fails, the operations that weren't written
+// completely are discarded, and LastVersion returns the last one that
+// was.
+func (w *WAL) Append(version uint64, ops []Operation) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.last != 0 && version <= w.last {
+		return fmt.Errorf("rig: WAL version %d is not after %d", version, w.last)
+	}
+	err := w.append(version, ops)
+	if err != nil {
+		w.discardUnwritten()
+	}
+	return err
+}
+
+// append writes operations to w.w and flushes it.
+// The caller must hold w.lock.
+func (w *WAL) append(version uint64, ops []Operation) error {
+	for _, op := range ops {
+		if w.file == nil || w.size >= w.segmentSize || (w.last != 0 && version != w.last+1) {
+			err := w.startSegment(version)
+			if err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(op)
+		if err != nil {
+			return err
+		}
+		record := make([]byte, walRecordHeaderSize+8+len(data))
+		payload := record[walRecordHeaderSize:]
+		binary.BigEndian.PutUint64(payload, version)
+		copy(payload[8:], data)
+		binary.BigEndian.PutUint32(record, uint32(len(payload)))
+		binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+		_, err = w.w.Write(record)
+		if err != nil {
+			return err
+		}
+		w.size += int64(len(record))
+		w.last = version
+		version++
+	}
+	err := w.w.Flush()
+	if err != nil {
+		return err
+	}
+	w.written = w.size
+	w.writtenLast = w.last
+	return nil
+}
+
+// discardUnwritten discards what was written to the current segment
+// after w was last flushed successfully, which can end with part of a
+// record, and replaces the file and w, which keeps returning the error
+// it failed with. If that fails, the next append starts a new segment.
+// The caller must hold w.lock.
+func (w *WAL) discardUnwritten() {
+	w.last = w.writtenLast
+	if w.file == nil {
+		return
+	}
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+	name := w.file.Name()
+	w.file.Close()
+	w.file = nil
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	err = f.Truncate(w.written)
+	if err == nil {
+		_, err = f.Seek(w.written, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	w.file = f
+	w.w = bufio.NewWriter(f)
+	w.size = w.written
+}
+
+// startSegment syncs and closes the current segment and
+// creates one for a version. The caller must hold w.lock.
+func (w *WAL) startSegment(version uint64) error {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+	if w.file != nil {
+		err := w.w.Flush()
+		if err == nil {
+			err = w.file.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		w.file.Close()
+		w.synced = w.last
+		w.writtenLast = w.last
+	}
+	w.written = 0
+	f, err := os.OpenFile(w.segmentName(version), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		w.file = nil
+		return err
+	}
+	err = syncDir(w.dir)
+	if err != nil {
+		f.Close()
+		w.file = nil
+		return err
+	}
+	w.file = f
+	w.w = bufio.NewWriter(f)
+	w.size = 0
+	w.segments = append(w.segments, version)
+	return nil
+}
+
+// Sync makes the operations up to a version durable.
+func (w *WAL) Sync(version uint64) error {
+	w.lock.Lock()
+	f := w.file
+	last := w.last
+	w.lock.Unlock()
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+	if w.synced >= version || f == nil {
+		// Starting a segment syncs the one before it,
+		// so f is only closed if it's already synced.
+		return nil
+	}
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+	if last > w.synced {
+		w.synced = last
+	}
+	return nil
+}
+
+// SyncedVersion returns the last version that is durable in the WAL.
+func (w *WAL) SyncedVersion() uint64 {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+	return w.synced
+}
+
+// Truncate removes the segments that only have versions up to version.
+// The current segment is never removed.
+func (w *WAL) Truncate(version uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for len(w.segments) > 1 && w.segments[1] <= version+1 {
+		err := os.Remove(w.segmentName(w.segments[0]))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	return nil
+}
+
+// Replay calls fn for the operations after a version in order.
+func (w *WAL) Replay(after uint64, fn func(version uint64, op Operation) error) error {
+	w.lock.Lock()
+	segments := append([]uint64(nil), w.segments...)
+	w.lock.Unlock()
+	for i, first := range segments {
+		if i+1 < len(segments) && segments[i+1] <= after+1 {
+			continue
+		}
+		f, err := os.Open(w.segmentName(first))
+		if err != nil {
+			return err
+		}
+		err = readWALRecords(f, func(version uint64, op Operation, offset int64) error {
+			if version <= after {
+				return nil
+			}
+			return fn(version, op)
+		})
+		f.Close()
+		if err == errWALCorrupt && i == len(segments)-1 {
+			// Written after the WAL was opened.
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the WAL.
+func (w *WAL) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.w.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+}
+
+// readWALRecords calls fn for each record with the offset after it. It
+// returns errWALCorrupt if it reaches a record that is incomplete.
+func readWALRecords(f *os.File, fn func(version uint64, op Operation, offset int64) error) error {
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	header := make([]byte, walRecordHeaderSize)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return errWALCorrupt
+		}
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(r, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errWALCorrupt
+		}
+		if err != nil {
+			return err
+		}
+		if len(payload) < 8 || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return errWALCorrupt
+		}
+		var op Operation
+		err = json.Unmarshal(payload[8:], &op)
+		if err != nil {
+			return errWALCorrupt
+		}
+		offset += int64(walRecordHeaderSize + len(payload))
+		err = fn(binary.BigEndian.Uint64(payload), op, offset)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// syncDir syncs a directory so that new files in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// SetWAL makes the service append operations to a WAL and sync it
+// before ApplyBatch returns. Flush still writes them to the object
+// store, and Recover replays the operations in the WAL that aren't
+// in the object store yet. Segments are removed once all of their
+// versions are flushed. durability sets whether waiting until
+// operations are durable waits for the WAL or the object store.
+//
+// SetWAL must be called before Recover.
+func (rs *RiggedService) SetWAL(wal *WAL, durability Durability) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.wal = wal
+	rs.durability = durability
+}
+
+// appendWAL appends applied operations to the WAL, along with the pending
+// operations before them that a failed append left out. They have to be
+// in the WAL for the operations after them to be recovered from it, but
+// operations that are no longer pending are flushed, so they don't.
+// The caller must hold rs.lock.
+func (rs *RiggedService) appendWAL(version uint64, ops []Operation) error {
+	if rs.wal == nil || len(ops) == 0 {
+		return nil
+	}
+	last := rs.wal.LastVersion()
+	// The versions of the pending operations, which end with ops.
+	firstPending := rs.currentVersion - uint64(len(rs.pending)) + 1
+	if last != 0 && last+1 < version && last+1 >= firstPending {
+		return rs.wal.Append(last+1, rs.pending[last+1-firstPending:])
+	}
+	return rs.wal.Append(version, ops)
+}
+
+// syncWAL makes the operations up to a version durable in the WAL.
+func (rs *RiggedService) syncWAL(version uint64) error {
+	rs.lock.Lock()
+	wal := rs.wal
+	rs.lock.Unlock()
+	if wal == nil {
+		return nil
+	}
+	return wal.Sync(version)
+}
+
+// truncateWAL removes the WAL segments that are flushed.
+// The caller must hold rs.lock.
+func (rs *RiggedService) truncateWAL() {
+	if rs.wal != nil {
+		// Failing to remove a segment only leaves
+		// it for the next flush to remove.
+		rs.wal.Truncate(rs.lastFlush)
+	}
+}
+
+// recoverWAL applies the operations in the WAL after the current
+// version, which become pending again. The caller must hold rs.lock.
+func (rs *RiggedService) recoverWAL() error {
+	if rs.wal == nil {
+		return nil
+	}
+	return rs.wal.Replay(rs.currentVersion, func(version uint64, op Operation) error {
+		if version != rs.currentVersion+1 {
+			return fmt.Errorf("rig: WAL is missing versions %d to %d", rs.currentVersion+1, version-1)
+		}
+		upcasted, err := rs.upcasters.Upcast(op)
+		if err != nil {
+			return err
+		}
+		err = rs.applyOperation(version, upcasted)
+		if err != nil {
+			return err
+		}
+		rs.currentVersion = version
+		rs.pending = append(rs.pending, op)
+		rs.pendingBytes += operationSize(op)
+		return nil
+	})
+}
+
+// durable returns true if a version is durable.
+func (rs *RiggedService) durable(version uint64) bool {
+	if atomic.LoadUint64(&rs.lastFlush) >= version {
+		return true
+	}
+	rs.lock.Lock()
+	wal := rs.wal
+	durability := rs.durability
+	rs.lock.Unlock()
+	return wal != nil && durability == DurableInWAL && wal.SyncedVersion() >= version
+}
@@ -0,0 +1,213 @@
+package rig
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func walSegments(t *testing.T, dir string) int {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func replayWAL(t *testing.T, w *WAL, after uint64) []uint64 {
+	t.Helper()
+	versions := []uint64{}
+	err := w.Replay(after, func(version uint64, op Operation) error {
+		versions = append(versions, version)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := OpenWAL(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := Operation{Method: "set", Data: []byte("abc")}
+	for version := uint64(1); version <= 6; version += 2 {
+		if err = w.Append(version, []Operation{op, op}); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Sync(version + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Append(3, []Operation{op}); err == nil {
+		t.Fatal("expected an error appending a version that was already appended")
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segments := walSegments(t, dir)
+	if segments < 2 {
+		t.Fatalf("expected more than one segment, got %d", segments)
+	}
+
+	// A partially written record is discarded.
+	f, err := os.OpenFile(filepath.Join(dir, "0000000000000007.wal"), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 40, 1, 2})
+	f.Close()
+	w, err = OpenWAL(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if last := w.LastVersion(); last != 6 {
+		t.Fatalf("expected the last version to be 6, got %d", last)
+	}
+	if versions := replayWAL(t, w, 3); !reflect.DeepEqual(versions, []uint64{4, 5, 6}) {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	if err = w.Append(7, []Operation{op}); err != nil {
+		t.Fatal(err)
+	}
+	if versions := replayWAL(t, w, 5); !reflect.DeepEqual(versions, []uint64{6, 7}) {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+
+	if err = w.Truncate(7); err != nil {
+		t.Fatal(err)
+	}
+	if segments = walSegments(t, dir); segments != 1 {
+		t.Fatalf("expected 1 segment after truncating, got %d", segments)
+	}
+	if versions := replayWAL(t, w, 0); !reflect.DeepEqual(versions, []uint64{7}) {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+}
+
+func TestRecoverFromWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storeDir := filepath.Join(dir, "store")
+	walDir := filepath.Join(dir, "wal")
+
+	open := func(service Service) (*RiggedService, *WAL) {
+		rs, err := NewRiggedService(service, NewFileObjectStore(storeDir), "svc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.testSleep = true
+		w, err := OpenWAL(walDir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.SetWAL(w, DurableInWAL)
+		if err = rs.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return rs, w
+	}
+
+	rs, w := open(&testService{})
+	op := Operation{Method: "set", Data: []byte("abc")}
+	for i := 0; i < 3; i++ {
+		if err = rs.Apply(op, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Durable once it's in the WAL, without flushing.
+	version, err := rs.ApplyBatch(context.Background(), []Operation{op, op}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 5 {
+		t.Fatalf("expected version 5, got %d", version)
+	}
+	w.Close()
+
+	// The operations that weren't flushed are recovered from the WAL.
+	service := &recordingService{}
+	rs, w = open(service)
+	defer w.Close()
+	status := rs.Status()
+	if status.CurrentVersion != 5 || status.LastFlush != 3 || status.Pending != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if len(service.ops) != 5 {
+		t.Fatalf("expected 5 operations to be applied, got %d", len(service.ops))
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if versions := logRecordVersions(t, storeDir); !reflect.DeepEqual(versions, []uint64{1, 4}) {
+		t.Fatalf("unexpected log records %v", versions)
+	}
+	if segments := walSegments(t, walDir); segments != 1 {
+		t.Fatalf("expected flushed segments to be removed, got %d segments", segments)
+	}
+	// An operation that can't be written to the WAL is still applied.
+	// The write fails after part of the record is written.
+	w.segmentSize = 1 << 20
+	w.w = bufio.NewWriter(&failingWriter{w: w.file, n: 5})
+	version, err = rs.ApplyBatch(context.Background(), []Operation{op}, false)
+	if walErr, ok := err.(WALError); !ok || walErr.Version != 6 || version != 6 {
+		t.Fatalf("expected WALError at version 6, got %d and %v", version, err)
+	}
+	// The next append writes it along with the next operation.
+	version, err = rs.ApplyBatch(context.Background(), []Operation{op}, true)
+	if err != nil || version != 7 {
+		t.Fatalf("expected version 7, got %d and %v", version, err)
+	}
+	w.Close()
+
+	rs, w = open(&testService{})
+	defer w.Close()
+	if status = rs.Status(); status.CurrentVersion != 7 || status.LastFlush != 5 || status.Pending != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if _, err = rs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if status = rs.Status(); status.LastFlush != 7 || status.Pending != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+// failingWriter writes the first n bytes written to it to w
+// and then fails.
+type failingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) <= fw.n {
+		fw.n -= len(p)
+		return fw.w.Write(p)
+	}
+	n, _ := fw.w.Write(p[:fw.n])
+	fw.n -= n
+	return n, errors.New("write failed")
+}